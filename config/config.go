@@ -8,13 +8,106 @@ type Config struct {
 	URI               string
 	FilesystemMaxSize int64
 
+	// MinFreePercent is the free space to maintain on the recording disk by
+	// removing the oldest events. CriticalFreePercent is the free space below
+	// which recording is refused and an alert is sent. Zero disables each.
+	// Changes require a restart.
+	MinFreePercent      float64
+	CriticalFreePercent float64
+
+	// MaxAgeDays is the age after which events are deleted. Zero disables
+	// deletion by age.
+	MaxAgeDays int
+
+	// RetentionDaysByClass overrides MaxAgeDays for events by detected class,
+	// e.g. {"motion": 3, "car": 14, "person": 60}. "motion" applies to events
+	// without detections. Changes require a restart.
+	RetentionDaysByClass map[string]int
+
+	// TrashExpiryDays is how long deleted events stay in the trash before
+	// they are purged. Defaults to 7. Changes require a restart.
+	TrashExpiryDays int
+
+	// RetentionTiers progressively reduce the size of old events, ordered by
+	// age. Events are only deleted once over FilesystemMaxSize.
+	RetentionTiers []RetentionTier
+
+	// Storage, if set, offloads finished events. FilesystemMaxSize then limits
+	// the local copies, which are removed once offloaded when over budget.
+	Storage *StorageConfig
+
+	// Encryption, if set, encrypts event files at rest.
+	Encryption *EncryptionConfig
+
+	// CameraName is displayed in overlays. Defaults to "Gate".
+	CameraName string
+
+	// Overlays defines what is drawn on each output, keyed by output name
+	// ("raw", "live" or "record"). If unset, DefaultOverlays is used.
+	Overlays map[string]OverlayConfig
+
 	NotificationHoursStart int
 	NotificationHoursEnd   int
 
+	// Transform corrects the orientation and lens of the camera image.
+	Transform TransformConfig
+
+	// PrivacyMasks are regions hidden on every frame before it reaches any
+	// output.
+	PrivacyMasks []PrivacyMask
+
+	// Views are virtual cameras derived from regions of the image, each
+	// available as an MJPEG stream named "view-<name>".
+	Views map[string]ViewConfig
+
 	MotionBounds []image.Point
 	MotionThresh float64
 	MotionErode  int
 
+	// SpriteIntervalSec is the time between frames of event sprite sheets.
+	// Defaults to 2.
+	SpriteIntervalSec int
+
+	// JobConcurrency is the number of post-processing jobs (video thumbnails,
+	// sprite sheets) run at once. Defaults to 1.
+	JobConcurrency int
+
+	// JobMaxAttempts is the number of times a post-processing job is tried
+	// before it is marked as failed. Defaults to 5.
+	JobMaxAttempts int
+
 	// If non-zero, limits the record time to this value. Otherwise, use default.
 	MaxRecordTimeSec int
+
+	// RecordMode selects how clips are recorded. "encode" (the default)
+	// encodes the images captured by OpenCV, while "passthrough" copies the
+	// camera's native stream without re-encoding. OpenCV is then only used for
+	// motion detection and classification. Passthrough can't be combined with
+	// PrivacyMasks; if they are added while running, clips are encoded instead.
+	RecordMode string
+
+	// PassthroughURI optionally overrides URI for passthrough recording, for
+	// example to record a higher resolution stream than is analyzed.
+	PassthroughURI string
+
+	// EncodingProfiles defines named encoder settings, which extend (or
+	// override) DefaultEncodingProfiles.
+	EncodingProfiles map[string]EncodingProfile
+
+	// Names of the encoding profiles used for the recorded clip, the video
+	// thumbnail and live streams. If empty, "default", "vthumb" and "live" are
+	// used respectively. These apply to the one camera served by this
+	// configuration; there is no per-camera selection until multiple camera
+	// inputs are supported.
+	VideoEncodingProfile  string
+	VThumbEncodingProfile string
+	LiveEncodingProfile   string
+}
+
+// PrivacyMask is a polygon which is hidden from all outputs.
+type PrivacyMask struct {
+	Points []image.Point
+
+	// Mode is "black" (default) to fill the region, or "pixelate".
+	Mode string
 }
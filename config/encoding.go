@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+)
+
+// EncodingProfile describes the ffmpeg encoder settings for a video output.
+type EncodingProfile struct {
+	// Codec is the ffmpeg encoder name, e.g. libx264, libx265, libvpx-vp9,
+	// libaom-av1 or libsvtav1.
+	Codec string
+
+	// Preset trades off encoding speed against compression. For libvpx-vp9 and
+	// libaom-av1 this is passed as -cpu-used instead.
+	Preset string
+
+	// CRF sets constant quality mode. Takes precedence over Bitrate.
+	CRF int
+	// Bitrate is the target bitrate in ffmpeg notation (e.g. "2M"), used if CRF
+	// is not set.
+	Bitrate string
+
+	// Width and Height scale the output. Set one to zero to preserve the aspect
+	// ratio, or both to keep the source size.
+	Width, Height int
+
+	// GOP is the maximum keyframe interval in frames.
+	GOP int
+
+	Profile     string
+	Level       string
+	PixelFormat string
+
+	// Threads limits encoder threads. Zero lets ffmpeg decide.
+	Threads int
+}
+
+// DefaultEncodingProfiles are always available, unless overridden by the
+// configuration file.
+var DefaultEncodingProfiles = map[string]EncodingProfile{
+	// Use h264 encoding with reasonable quality and speed. Note that "preset"
+	// can be adjusted if the system is too slow to handle encoding. Baseline
+	// profile allows playback on a wider range of devices.
+	"default": {
+		Codec:       "libx264",
+		Preset:      "ultrafast",
+		CRF:         30,
+		Profile:     "baseline",
+		Level:       "3.0",
+		PixelFormat: "yuv420p",
+	},
+	// Fast, fairly low quality. Keep CPU usage down since thumbnail conversion
+	// doesn't need to be fast.
+	"vthumb": {
+		Codec:       "libx264",
+		Preset:      "fast",
+		CRF:         28,
+		Width:       320,
+		Height:      180,
+		Profile:     "baseline",
+		Level:       "3.0",
+		PixelFormat: "yuv420p",
+		Threads:     1,
+	},
+	// Live streams favor low latency. GOP should match the live segment
+	// duration so segments can be cut on keyframes.
+	"live": {
+		Codec:       "libx264",
+		Preset:      "veryfast",
+		CRF:         28,
+		GOP:         30,
+		Profile:     "baseline",
+		Level:       "3.1",
+		PixelFormat: "yuv420p",
+	},
+}
+
+// GetEncodingProfile looks up a profile by name, preferring the configuration
+// file over the defaults.
+func (c *Config) GetEncodingProfile(name string) (EncodingProfile, error) {
+	if p, ok := c.EncodingProfiles[name]; ok {
+		return p, nil
+	}
+	if p, ok := DefaultEncodingProfiles[name]; ok {
+		return p, nil
+	}
+	return EncodingProfile{}, fmt.Errorf("unknown encoding profile %q", name)
+}
+
+// VideoProfile returns the encoding profile for recorded clips.
+func (c *Config) VideoProfile() (EncodingProfile, error) {
+	if c.VideoEncodingProfile == "" {
+		return c.GetEncodingProfile("default")
+	}
+	return c.GetEncodingProfile(c.VideoEncodingProfile)
+}
+
+// VThumbProfile returns the encoding profile for video thumbnails.
+func (c *Config) VThumbProfile() (EncodingProfile, error) {
+	if c.VThumbEncodingProfile == "" {
+		return c.GetEncodingProfile("vthumb")
+	}
+	return c.GetEncodingProfile(c.VThumbEncodingProfile)
+}
+
+// LiveProfile returns the encoding profile for live streams.
+func (c *Config) LiveProfile() (EncodingProfile, error) {
+	if c.LiveEncodingProfile == "" {
+		return c.GetEncodingProfile("live")
+	}
+	return c.GetEncodingProfile(c.LiveEncodingProfile)
+}
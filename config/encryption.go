@@ -0,0 +1,13 @@
+package config
+
+// EncryptionConfig enables encryption at rest of event files. Changes require
+// a restart.
+type EncryptionConfig struct {
+	// Key is a base64 encoded 256-bit key, e.g. from "openssl rand -base64
+	// 32". If empty, the CAM_ENCRYPTION_KEY environment variable is used.
+	Key string
+
+	// PreviousKeys can still decrypt existing files. After changing Key, run
+	// with -rotate_key to re-encrypt them.
+	PreviousKeys []string
+}
@@ -0,0 +1,60 @@
+package config
+
+const (
+	// Overlay outputs.
+	OverlayRaw    = "raw"
+	OverlayLive   = "live"
+	OverlayRecord = "record"
+)
+
+// OverlayConfig describes the information drawn on top of video frames.
+type OverlayConfig struct {
+	// Lines of text to draw. "{camera}" and "{time}" are replaced by the camera
+	// name and the frame time.
+	Lines []string
+
+	// TimeFormat is a Go time layout. Defaults to "2006-01-02 15:04:05 MST".
+	TimeFormat string
+
+	// Timezone is an IANA zone name, e.g. "America/Los_Angeles". Defaults to
+	// local time.
+	Timezone string
+
+	// Position is one of "top-left" (default), "top-right", "bottom-left" or
+	// "bottom-right".
+	Position string
+
+	// FontScale defaults to 0.5.
+	FontScale float64
+
+	// Detections draws boxes and class labels for recent classifier results.
+	Detections bool
+
+	// RecordingIndicator draws a marker while an event is being recorded.
+	RecordingIndicator bool
+}
+
+// DefaultOverlays matches the original fixed timestamp banner.
+var DefaultOverlays = map[string]OverlayConfig{
+	OverlayLive:   {Lines: []string{"{camera} - {time}"}},
+	OverlayRecord: {Lines: []string{"{camera} - {time}"}},
+}
+
+// GetOverlay returns the overlay for an output, and false if nothing should be
+// drawn.
+func (c *Config) GetOverlay(output string) (OverlayConfig, bool) {
+	overlays := c.Overlays
+	if overlays == nil {
+		overlays = DefaultOverlays
+	}
+	o, ok := overlays[output]
+	return o, ok
+}
+
+// GetCameraName returns the display name of the camera.
+func (c *Config) GetCameraName() string {
+	if c.CameraName == "" {
+		return "Gate"
+	}
+	return c.CameraName
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retention tier actions.
+const (
+	// RetentionReencode re-encodes the video with the tier's encoding profile.
+	RetentionReencode = "reencode"
+
+	// RetentionPreviews removes the video, keeping only the thumbnail and
+	// video thumbnail.
+	RetentionPreviews = "previews"
+)
+
+// RetentionTier reduces the size of events once they reach an age, before
+// they are deleted by garbage collection.
+type RetentionTier struct {
+	AfterHours int
+
+	// Action is RetentionReencode or RetentionPreviews.
+	Action string
+
+	// EncodingProfile names the profile for RetentionReencode.
+	EncodingProfile string
+}
+
+// RetentionTierFor returns the tier (numbered from 1) which applies to an
+// event of the provided age, or 0 if none does.
+func (c *Config) RetentionTierFor(age time.Duration) int {
+	tier := 0
+	for i, t := range c.RetentionTiers {
+		if age >= time.Duration(t.AfterHours)*time.Hour {
+			tier = i + 1
+		}
+	}
+	return tier
+}
+
+// ValidateRetentionTiers checks that tiers are ordered and refer to known
+// encoding profiles, returning the profiles used.
+func (c *Config) ValidateRetentionTiers() ([]EncodingProfile, error) {
+	var profiles []EncodingProfile
+	for i, t := range c.RetentionTiers {
+		if i > 0 && t.AfterHours <= c.RetentionTiers[i-1].AfterHours {
+			return nil, fmt.Errorf("retention tier %d must be older than the previous tier", i+1)
+		}
+		switch t.Action {
+		case RetentionReencode:
+			p, err := c.GetEncodingProfile(t.EncodingProfile)
+			if err != nil {
+				return nil, fmt.Errorf("retention tier %d: %v", i+1, err)
+			}
+			profiles = append(profiles, p)
+		case RetentionPreviews:
+			if i != len(c.RetentionTiers)-1 {
+				return nil, fmt.Errorf("retention tier %d removes video so must be the last tier", i+1)
+			}
+		default:
+			return nil, fmt.Errorf("retention tier %d has unknown action %q", i+1, t.Action)
+		}
+	}
+	return profiles, nil
+}
@@ -0,0 +1,32 @@
+package config
+
+// StorageConfig describes where finished events are offloaded. Changes
+// require a restart.
+type StorageConfig struct {
+	// Type is "s3" for an S3-compatible bucket, or "dir" for a directory.
+	Type string
+
+	// S3 settings. Endpoint is the host and port, e.g. "localhost:9000" for
+	// MinIO.
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+
+	// Dir is the directory for the "dir" type.
+	Dir string
+
+	// Presign redirects clients to the backend with a presigned URL instead
+	// of streaming through this server, if supported.
+	Presign bool
+
+	// PresignExpirySec defaults to one hour.
+	PresignExpirySec int
+
+	// MaxSize is the total size threshold for garbage collection of
+	// offloaded events. Zero disables GC on size.
+	MaxSize int64
+}
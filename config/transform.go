@@ -0,0 +1,39 @@
+package config
+
+// TransformConfig corrects the camera image before any processing. Unlike
+// most settings, changes require a restart since the output size must remain
+// fixed while running.
+type TransformConfig struct {
+	// Undistort, if set, corrects lens distortion. It is applied first, since
+	// calibration is performed on the camera's native image.
+	Undistort *UndistortConfig
+
+	// Crop selects a region of the (undistorted) image.
+	Crop Crop
+
+	// Rotate clockwise by 0, 90, 180 or 270 degrees.
+	Rotate int
+
+	// FlipH and FlipV mirror the image horizontally and vertically, after
+	// rotation.
+	FlipH bool
+	FlipV bool
+}
+
+// UndistortConfig holds lens calibration parameters, as produced by OpenCV
+// camera calibration at the camera's native resolution.
+type UndistortConfig struct {
+	// Focal lengths and principal point in pixels.
+	FX, FY, CX, CY float64
+
+	// DistCoeffs are k1, k2, p1, p2[, k3...] for the standard model, or k1-k4
+	// for the fisheye model.
+	DistCoeffs []float64
+
+	Fisheye bool
+}
+
+// IsZero returns whether the transform leaves images unchanged.
+func (t TransformConfig) IsZero() bool {
+	return t.Undistort == nil && t.Crop.IsZero() && t.Rotate == 0 && !t.FlipH && !t.FlipV
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// Crop is a rectangle normalized to the image size, so that it remains valid
+// if the camera resolution changes. The zero value selects the whole image.
+type Crop struct {
+	X, Y, W, H float64
+}
+
+// ParseCrop parses a crop in the form "x,y,w,h".
+func ParseCrop(s string) (Crop, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Crop{}, fmt.Errorf("crop %q must be x,y,w,h", s)
+	}
+	var v [4]float64
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return Crop{}, fmt.Errorf("crop %q: %v", s, err)
+		}
+		v[i] = f
+	}
+	c := Crop{X: v[0], Y: v[1], W: v[2], H: v[3]}
+	if c.X < 0 || c.Y < 0 || c.W <= 0 || c.H <= 0 || c.X+c.W > 1 || c.Y+c.H > 1 {
+		return Crop{}, fmt.Errorf("crop %q must lie within 0-1", s)
+	}
+	return c, nil
+}
+
+// IsZero returns whether the crop selects the whole image.
+func (c Crop) IsZero() bool {
+	return c == Crop{}
+}
+
+// Rect converts the crop to pixels for an image of the provided size. The
+// result is never empty.
+func (c Crop) Rect(size image.Point) image.Rectangle {
+	bounds := image.Rectangle{Max: size}
+	if c.IsZero() {
+		return bounds
+	}
+	r := image.Rect(
+		int(c.X*float64(size.X)),
+		int(c.Y*float64(size.Y)),
+		int((c.X+c.W)*float64(size.X)),
+		int((c.Y+c.H)*float64(size.Y)),
+	).Intersect(bounds)
+	if r.Empty() {
+		return bounds
+	}
+	return r
+}
+
+// ViewConfig describes a virtual view: a stream derived from a region of the
+// camera image.
+type ViewConfig struct {
+	Crop Crop
+
+	// Width and Height optionally scale the cropped region. If only one is
+	// set, the aspect ratio is preserved.
+	Width  int
+	Height int
+}
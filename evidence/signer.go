@@ -0,0 +1,98 @@
+// Package evidence signs exported events so that recipients can check they
+// were not altered after leaving the server.
+package evidence
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// SigningKey is the server's ed25519 key pair, PEM encoded. The public key is
+// in PKIX form and the private key in PKCS #8 form, as used by openssl.
+type SigningKey struct {
+	Public  string
+	Private string
+}
+
+type Signer struct {
+	// Key will be generated on first startup and persisted in the database.
+	Key *SigningKey
+
+	priv ed25519.PrivateKey
+}
+
+func NewSigner(db *gorm.DB) (*Signer, error) {
+	db.AutoMigrate(&SigningKey{})
+
+	s := &Signer{
+		Key: &SigningKey{},
+	}
+	// Load signing key from database, otherwise create.
+	if err := db.First(s.Key).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		if err := s.generate(); err != nil {
+			return nil, err
+		}
+		if err := db.Create(s.Key).Error; err != nil {
+			return nil, err
+		}
+		log.Infof("Evidence signing key generated")
+	} else if err != nil {
+		return nil, err
+	} else {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+		log.Infof("Evidence signing key loaded from database")
+	}
+	return s, nil
+}
+
+func (s *Signer) generate() error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return err
+	}
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return err
+	}
+	s.Key.Public = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+	s.Key.Private = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+	s.priv = priv
+	return nil
+}
+
+func (s *Signer) load() error {
+	block, _ := pem.Decode([]byte(s.Key.Private))
+	if block == nil {
+		return errors.New("stored signing key is not PEM encoded")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return fmt.Errorf("stored signing key is %T, not ed25519", key)
+	}
+	s.priv = priv
+	return nil
+}
+
+// Sign returns a detached ed25519 signature of data. It can be checked with
+// e.g. "openssl pkeyutl -verify -pubin -inkey key.pem -rawin -in data
+// -sigfile data.sig".
+func (s *Signer) Sign(data []byte) []byte {
+	return ed25519.Sign(s.priv, data)
+}
@@ -8,19 +8,23 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"cam/config"
+	"cam/evidence"
 	"cam/notify"
 	"cam/serve"
 	"cam/util"
 	"cam/video"
+	"cam/video/crypt"
 	"cam/video/process"
 	"cam/video/sink"
 	"cam/video/source"
+	"cam/video/storage"
 
 	assetfs "github.com/elazarl/go-bindata-assetfs"
 	"github.com/gorilla/handlers"
@@ -37,6 +41,8 @@ var (
 	rootPath   = flag.String("root", "/tmp", "Root path for storing videos")
 	configFile = flag.String("config", "config.template.json", "Path to the camera configuration file")
 	database   = flag.String("database", os.Getenv("DATABASE"), "Mysql database path. Required.")
+	reconcile  = flag.Bool("reconcile", false, "Run a filesystem consistency check and exit.")
+	rotateKey  = flag.Bool("rotate_key", false, "Re-encrypt event files with the current encryption key in the background.")
 
 	BuildTimestamp string
 	BuildGitHash   string
@@ -86,6 +92,33 @@ func main() {
 		log.Fatalf("URI is required")
 	}
 
+	videoProfile, err := config.Get().VideoProfile()
+	if err != nil {
+		log.Fatalf("Invalid video encoding profile: %v", err)
+	}
+	vthumbProfile, err := config.Get().VThumbProfile()
+	if err != nil {
+		log.Fatalf("Invalid video thumbnail encoding profile: %v", err)
+	}
+	liveProfile, err := config.Get().LiveProfile()
+	if err != nil {
+		log.Fatalf("Invalid live encoding profile: %v", err)
+	}
+	for name, p := range map[string]config.EncodingProfile{"video": videoProfile, "vthumb": vthumbProfile, "live": liveProfile} {
+		if err := sink.ProbeEncodingProfile(ffmpegp, p); err != nil {
+			log.Fatalf("FFmpeg does not support %s encoding profile %+v: %v", name, p, err)
+		}
+	}
+	retentionProfiles, err := config.Get().ValidateRetentionTiers()
+	if err != nil {
+		log.Fatalf("Invalid retention tiers: %v", err)
+	}
+	for _, p := range retentionProfiles {
+		if err := sink.ProbeEncodingProfile(ffmpegp, p); err != nil {
+			log.Fatalf("FFmpeg does not support retention encoding profile %+v: %v", p, err)
+		}
+	}
+
 	fps := 15
 
 	inputfps := fps
@@ -95,7 +128,10 @@ func main() {
 	}
 
 	// TODO increase FPS for live sources.
-	cap := source.NewVideoCapture(uri, inputfps)
+	cap, err := source.NewTransform(source.NewVideoCapture(uri, inputfps), config.Get().Transform)
+	if err != nil {
+		log.Fatalf("Invalid transform: %v", err)
+	}
 	// defer cap.Close()
 
 	c := cap.Get()
@@ -112,20 +148,99 @@ func main() {
 		DatabaseURI: *database,
 		BasePath:    *rootPath,
 		MaxSize:     config.Get().FilesystemMaxSize,
+		MaxAge:      time.Duration(config.Get().MaxAgeDays) * 24 * time.Hour,
+		ClassMaxAge: make(map[string]time.Duration),
+		TrashExpiry: time.Duration(config.Get().TrashExpiryDays) * 24 * time.Hour,
+
+		MinFreePercent:      config.Get().MinFreePercent,
+		CriticalFreePercent: config.Get().CriticalFreePercent,
+	}
+	for class, days := range config.Get().RetentionDaysByClass {
+		fsOpts.ClassMaxAge[class] = time.Duration(days) * 24 * time.Hour
+	}
+	if sc := config.Get().Storage; sc != nil {
+		remote, err := storage.New(sc)
+		if err != nil {
+			log.Fatalf("Failed to set up %s storage: %v", sc.Type, err)
+		}
+		fsOpts.Remote = remote
+		fsOpts.RemoteMaxSize = sc.MaxSize
+	}
+	keyring, err := crypt.New(config.Get().Encryption)
+	if err != nil {
+		log.Fatalf("Failed to set up encryption: %v", err)
 	}
+	fsOpts.Keyring = keyring
 	fs, err := video.NewFilesystem(fsOpts)
 	if err != nil {
 		log.Fatalf("Failed to create filesystem: %v", err)
 	}
 
+	if *reconcile {
+		// Previews are left for the next regular startup to regenerate.
+		if _, err := fs.Reconcile(nil); err != nil {
+			log.Fatalf("Filesystem consistency check failed: %v", err)
+		}
+		return
+	}
+
+	jobs := video.NewJobQueue(fs, video.JobQueueOptions{
+		Concurrency:     config.Get().JobConcurrency,
+		MaxAttempts:     config.Get().JobMaxAttempts,
+		VThumbProducer:  process.NewVThumbProducer(vthumbProfile),
+		ReencodeProfile: videoProfile,
+	})
+	defer jobs.Close()
+
+	// Clean up after any previous unclean shutdown before recording starts.
+	if _, err := fs.Reconcile(jobs); err != nil {
+		log.Errorf("Filesystem consistency check failed: %v", err)
+	}
+	if *rotateKey {
+		if keyring == nil {
+			log.Fatalf("-rotate_key requires an encryption key")
+		}
+		log.Infof("Re-encrypting %d events with the current key", jobs.EnqueueEncrypt())
+	}
+
 	vp := &video.VideoSinkProducer{
 		FFmpegOptions: sink.FFmpegOptions{
 			Size:       cap.Size(),
 			FPS:        fps,
 			BufferTime: buftime,
+			Encoding:   videoProfile,
 		},
-		Filesystem:     fs,
-		VThumbProducer: process.NewVThumbProducer(),
+		Filesystem: fs,
+		Jobs:       jobs,
+	}
+
+	switch mode := config.Get().RecordMode; mode {
+	case "", "encode":
+	case "passthrough":
+		// The native stream can't be masked without re-encoding it.
+		if len(config.Get().PrivacyMasks) > 0 {
+			log.Fatalf("PrivacyMasks are not supported with passthrough recording; use the encode record mode")
+		}
+		if !config.Get().Transform.IsZero() {
+			log.Warnf("Transform is not applied to passthrough recordings")
+		}
+		puri := config.Get().PassthroughURI
+		if puri == "" {
+			puri = uri
+		}
+		segments, err := sink.NewSegmentRing(sink.SegmentRingOptions{
+			URI:         puri,
+			Dir:         filepath.Join(*rootPath, "segments"),
+			SegmentTime: 2 * time.Second,
+			Retain:      buftime,
+		})
+		if err != nil {
+			log.Fatalf("Failed to set up passthrough recording: %v", err)
+		}
+		defer segments.Close()
+		vp.Segments = segments
+	default:
+		log.Fatalf("Unknown record mode %q", mode)
 	}
 
 	mjpegServer := sink.NewMJPEGServer()
@@ -136,6 +251,35 @@ func main() {
 	msdefault := mjpegServer.NewStream(sink.MJPEGID{Name: "default"})
 	defer msdefault.Close()
 
+	msprivacy := mjpegServer.NewStream(sink.MJPEGID{Name: "privacy"})
+	defer msprivacy.Close()
+
+	privacy := process.NewPrivacyMask(msprivacy)
+	defer privacy.Close()
+
+	views := process.NewViews(mjpegServer)
+	defer views.Close()
+
+	hls, err := sink.NewHLSServer(sink.HLSOptions{
+		Size:        cap.Size(),
+		FPS:         fps,
+		Encoding:    liveProfile,
+		SegmentTime: 2 * time.Second,
+		ListSize:    5,
+		IdleTimeout: 30 * time.Second,
+	})
+	if err != nil {
+		log.Fatalf("Failed to set up HLS: %v", err)
+	}
+	defer hls.Close()
+
+	fmp4 := sink.NewFMP4Stream(sink.FMP4Options{
+		Size:     cap.Size(),
+		FPS:      fps,
+		Encoding: liveProfile,
+	})
+	defer fmp4.Close()
+
 	prototxt, err := Asset("models/MobileNetSSD_deploy.prototxt")
 	if err != nil {
 		log.Fatalf("Failed to load model prototxt: %v", err)
@@ -156,6 +300,12 @@ func main() {
 		Classifier: classifier,
 	})
 
+	overlays := process.NewOverlays(classifier)
+	defer overlays.Close()
+	rec.Listeners = append(rec.Listeners, &video.OverlayRecordTrigger{
+		Overlays: overlays,
+	})
+
 	motion := process.NewMotion(mjpegServer, classifier, cap.Size())
 	// Trigger recorder on motion.
 	motion.Triggers = append(motion.Triggers, rec)
@@ -176,6 +326,11 @@ func main() {
 		log.Fatalf("Failed to set up web push: %v", err)
 	}
 
+	signer, err := evidence.NewSigner(fs.DB())
+	if err != nil {
+		log.Fatalf("Failed to set up evidence signing: %v", err)
+	}
+
 	notifyws := serve.NewMetaUpdater()
 
 	notifier := &notify.Notifier{
@@ -183,16 +338,38 @@ func main() {
 	}
 	motion.Triggers = append(motion.Triggers, notifier)
 	rec.Listeners = append(rec.Listeners, notifier)
+	fs.AddAlertListener(notifier)
 
 	go func() {
 		http.Handle("/mjpeg", mjpegServer)
+		http.HandleFunc("/snapshot", mjpegServer.ServeSnapshot)
+		http.Handle("/mjpeg/streams", &serve.MJPEGDirectoryServer{Server: mjpegServer})
+		http.Handle("/hls/", http.StripPrefix("/hls/", hls))
+		http.Handle("/livews", serve.NewLiveServer(fmp4))
 		http.Handle("/trigger", rec)
 		http.Handle("/events", handlers.CompressHandler(meta))
 		http.Handle("/eventsws", metaws)
 		http.Handle("/delete", delete)
+		http.Handle("/trash", &serve.TrashServer{FS: fs})
+		http.Handle("/trash/restore", &serve.RestoreServer{FS: fs})
+		http.Handle("/trash/empty", &serve.EmptyTrashServer{FS: fs})
+		http.Handle("/pin", &serve.PinServer{FS: fs})
+		http.Handle("/favorite", &serve.FavoriteServer{FS: fs})
+		http.Handle("/tags", &serve.TagServer{FS: fs})
+		http.Handle("/notes", &serve.NoteServer{FS: fs})
+		http.Handle("/bulk", &serve.BulkServer{FS: fs})
+		http.Handle("/export", &serve.ExportServer{FS: fs})
+		http.Handle("/clip", &serve.ClipServer{FS: fs, Jobs: jobs, PreRoll: buftime, Profile: videoProfile})
+		http.Handle("/evidence", &serve.EvidenceServer{FS: fs, Signer: signer})
+		http.Handle("/evidence/key", &serve.EvidenceKeyServer{Signer: signer})
+		http.Handle("/gc", &serve.GCServer{FS: fs})
+		http.Handle("/reconcile", &serve.ReconcileServer{FS: fs, Jobs: jobs})
+		http.Handle("/jobs", &serve.JobServer{Jobs: jobs})
 		http.Handle("/video", serve.NewVideoServer(fs))
 		http.Handle("/thumb", serve.NewThumbServer(fs))
 		http.Handle("/vthumb", serve.NewVThumbServer(fs))
+		http.Handle("/sprite", serve.NewSpriteServer(fs))
+		http.Handle("/vtt", serve.NewVTTServer(fs))
 		http.Handle("/notifyws", notifyws)
 		http.Handle("/metrics", promhttp.Handler())
 		http.HandleFunc("/build", func(w http.ResponseWriter, r *http.Request) {
@@ -237,17 +414,23 @@ func main() {
 	for ctx.Err() == nil {
 		select {
 		case i := <-c:
-			msraw.Put(i.Mat)
+			// Hide private regions before the image reaches any output.
+			privacy.Apply(i)
+
+			msraw.Put(overlays.Apply(config.OverlayRaw, i).Mat)
 
 			motion.Process(i.Mat)
+			views.Put(i)
 
-			i = process.DrawTimestamp("Gate", i)
-			//window.Put(i)
+			live := overlays.Apply(config.OverlayLive, i)
+			//window.Put(live)
 
-			msdefault.Put(i.Mat)
+			msdefault.Put(live.Mat)
+			hls.Put(live)
+			fmp4.Put(live)
 
 			//video.Put(i)
-			rec.Put(i)
+			rec.Put(overlays.Apply(config.OverlayRecord, i))
 
 			// All done with this image.
 			i.Close()
@@ -5,6 +5,7 @@ import (
 	"cam/video"
 	"cam/video/process"
 	"sync"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	log "github.com/sirupsen/logrus"
@@ -19,6 +20,10 @@ type Notification struct {
 	TimeString string
 	Identifier string
 	Detection  process.Detection
+
+	// Alert, if set, describes a problem with the system rather than a
+	// detection.
+	Alert string `json:",omitempty"`
 }
 
 type NotifyListener interface {
@@ -81,6 +86,22 @@ func (n *Notifier) MotionClassified(detection process.Detections) {
 	n.notified = true
 }
 
+// Alert is invoked when the system needs attention. Alerts ignore quiet hours.
+func (n *Notifier) Alert(message string) {
+	notification := &Notification{
+		TimeString: time.Now().Format("3:04 PM"),
+		Alert:      message,
+	}
+	log.Infof("Sending alert: %v", message)
+	for _, l := range n.Listeners {
+		go func(l NotifyListener) {
+			if err := l.Notify(notification); err != nil {
+				log.Errorf("Failed to send alert: %v", err)
+			}
+		}(l)
+	}
+}
+
 // StartRecording is invoked when the video recorder starts.
 func (n *Notifier) StartRecording(vr *video.VideoRecord) {
 	n.l.Lock()
@@ -0,0 +1,138 @@
+package serve
+
+import (
+	"cam/video"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"gorm.io/gorm"
+)
+
+// maxNoteLength bounds the size of a single note.
+const maxNoteLength = 4096
+
+// lookupRecord parses the form of a POST request and finds the record named by
+// its "id" parameter. On failure an error is written and nil returned.
+func lookupRecord(fs *video.Filesystem, w http.ResponseWriter, r *http.Request) *video.VideoRecord {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+	id := r.Form.Get("id")
+	vr := fs.GetRecordByID(id)
+	if vr == nil {
+		http.Error(w, fmt.Sprintf("No record found for id %v", id), http.StatusNotFound)
+	}
+	return vr
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// FavoriteServer stars or unstars an event. The "favorite" parameter defaults
+// to true.
+type FavoriteServer struct {
+	FS *video.Filesystem
+}
+
+func (s *FavoriteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vr := lookupRecord(s.FS, w, r)
+	if vr == nil {
+		return
+	}
+	favorite := true
+	if v := r.Form.Get("favorite"); v != "" {
+		var err error
+		if favorite, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for favorite: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	vr.SetFavorite(favorite)
+}
+
+// TagServer lists the tags in use along with their counts (GET), or changes
+// the tags of the event given by "id" (POST). The "add" and "remove"
+// parameters may each be repeated. The event's resulting tags are returned.
+type TagServer struct {
+	FS *video.Filesystem
+}
+
+func (s *TagServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		writeJSON(w, s.FS.TagCounts())
+		return
+	}
+	vr := lookupRecord(s.FS, w, r)
+	if vr == nil {
+		return
+	}
+	for _, t := range r.Form["add"] {
+		if err := vr.AddTag(t); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to add tag %q: %v", t, err), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, t := range r.Form["remove"] {
+		if err := vr.RemoveTag(t); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to remove tag %q: %v", t, err), http.StatusBadRequest)
+			return
+		}
+	}
+	writeJSON(w, vr.Tags)
+}
+
+// NoteServer adds a note with the given "text" to the event given by "id", or
+// removes the note whose ID is given by "delete". Added notes are returned.
+type NoteServer struct {
+	FS *video.Filesystem
+}
+
+func (s *NoteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	vr := lookupRecord(s.FS, w, r)
+	if vr == nil {
+		return
+	}
+
+	if v := r.Form.Get("delete"); v != "" {
+		id, err := strconv.ParseUint(v, 10, 0)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for delete: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := vr.DeleteNote(uint(id)); err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				code = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), code)
+		}
+		return
+	}
+
+	text := r.Form.Get("text")
+	if text == "" || len(text) > maxNoteLength {
+		http.Error(w, fmt.Sprintf("Note must be between 1 and %d bytes", maxNoteLength), http.StatusBadRequest)
+		return
+	}
+	n, err := vr.AddNote(text)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, n)
+}
@@ -0,0 +1,136 @@
+package serve
+
+import (
+	"cam/video"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// parseSelection reads the events selected by a bulk request: either a list
+// of "id" parameters, or a filter made of "from" and "to" (Unix seconds),
+// "class", "tag" and "favorite". An empty selection is rejected so that a
+// malformed request can't affect every event.
+func parseSelection(r *http.Request) (*video.RecordsFilter, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	filter := &video.RecordsFilter{
+		Identifiers: r.Form["id"],
+		Classes:     r.Form["class"],
+		Tags:        r.Form["tag"],
+	}
+	if v := r.Form.Get("favorite"); v != "" {
+		var err error
+		if filter.Favorite, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("invalid value for favorite: %v", err)
+		}
+	}
+	parseTime := func(name string) (time.Time, error) {
+		v := r.Form.Get(name)
+		if v == "" {
+			return time.Time{}, nil
+		}
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid value for %v: %v", name, err)
+		}
+		return time.Unix(ts, 0), nil
+	}
+	var err error
+	if filter.After, err = parseTime("from"); err != nil {
+		return nil, err
+	}
+	if filter.Before, err = parseTime("to"); err != nil {
+		return nil, err
+	}
+	if len(filter.Identifiers) == 0 && len(filter.Classes) == 0 && len(filter.Tags) == 0 &&
+		!filter.Favorite && filter.After.IsZero() && filter.Before.IsZero() {
+		return nil, errors.New("no events selected")
+	}
+	return filter, nil
+}
+
+// BulkServer applies an action to every selected event (see parseSelection).
+// The "action" parameter is one of:
+//
+//	delete, with optional "permanent": move to the trash, or delete.
+//	pin, unpin: set whether exempt from garbage collection.
+//	favorite, unfavorite: star or unstar.
+//	tag, with repeated "add" and "remove": change tags.
+type BulkServer struct {
+	FS *video.Filesystem
+}
+
+func (s *BulkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseSelection(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var fn func(vr *video.VideoRecord) error
+	switch action := r.Form.Get("action"); action {
+	case "delete":
+		var permanent bool
+		if v := r.Form.Get("permanent"); v != "" {
+			if permanent, err = strconv.ParseBool(v); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid value for permanent: %v", err), http.StatusBadRequest)
+				return
+			}
+		}
+		fn = func(vr *video.VideoRecord) error {
+			if permanent {
+				if vr.Recording() {
+					return errors.New("event is still recording")
+				}
+				vr.Delete()
+				return nil
+			}
+			return vr.Trash()
+		}
+	case "pin", "unpin":
+		fn = func(vr *video.VideoRecord) error {
+			vr.SetPinned(action == "pin")
+			return nil
+		}
+	case "favorite", "unfavorite":
+		fn = func(vr *video.VideoRecord) error {
+			vr.SetFavorite(action == "favorite")
+			return nil
+		}
+	case "tag":
+		add, remove := r.Form["add"], r.Form["remove"]
+		for _, t := range append(add, remove...) {
+			if _, err := video.NormalizeTag(t); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid tag %q: %v", t, err), http.StatusBadRequest)
+				return
+			}
+		}
+		fn = func(vr *video.VideoRecord) error {
+			for _, t := range add {
+				if err := vr.AddTag(t); err != nil {
+					return err
+				}
+			}
+			for _, t := range remove {
+				if err := vr.RemoveTag(t); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Invalid action %q", action), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, s.FS.UpdateRecords(s.FS.GetRecords(filter), fn))
+}
@@ -0,0 +1,158 @@
+package serve
+
+import (
+	"cam/config"
+	"cam/video"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ClipServer cuts a clip from recorded footage. The clip is either part of the
+// event given by "id", between the "start" and "end" offsets in seconds, or
+// covers the wall clock range given by "from" and "to" in Unix seconds, across
+// consecutive events. "exact" re-encodes for frame-accurate cuts, and
+// "timestamp" burns in the time. The clip is downloaded, or with "save" (POST
+// only) kept as a new pinned event which is returned.
+type ClipServer struct {
+	FS   *video.Filesystem
+	Jobs *video.JobQueue
+
+	// PreRoll is the recorder buffer time, which precedes each event's
+	// trigger time in its video.
+	PreRoll time.Duration
+	Profile config.EncodingProfile
+}
+
+func parseClipRequest(r *http.Request) (*video.ClipRequest, error) {
+	parseFloat := func(name string) (float64, error) {
+		v := r.Form.Get(name)
+		if v == "" {
+			return 0, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return 0, fmt.Errorf("invalid value for %v: %v", name, v)
+		}
+		return f, nil
+	}
+	parseBool := func(name string) (bool, error) {
+		v := r.Form.Get(name)
+		if v == "" {
+			return false, nil
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("invalid value for %v: %v", name, err)
+		}
+		return b, nil
+	}
+
+	req := &video.ClipRequest{Identifier: r.Form.Get("id")}
+	var err error
+	if req.Exact, err = parseBool("exact"); err != nil {
+		return nil, err
+	}
+	if req.Timestamp, err = parseBool("timestamp"); err != nil {
+		return nil, err
+	}
+
+	if req.Identifier != "" {
+		start, err := parseFloat("start")
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseFloat("end")
+		if err != nil {
+			return nil, err
+		}
+		if end != 0 && end <= start {
+			return nil, errors.New("end must be after start")
+		}
+		req.Start = time.Duration(start * float64(time.Second))
+		req.End = time.Duration(end * float64(time.Second))
+		return req, nil
+	}
+
+	from, err := parseFloat("from")
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseFloat("to")
+	if err != nil {
+		return nil, err
+	}
+	if from == 0 || to <= from {
+		return nil, errors.New("either id, or from and to with to after from, is required")
+	}
+	req.From = time.Unix(0, int64(from*float64(time.Second)))
+	req.To = time.Unix(0, int64(to*float64(time.Second)))
+	return req, nil
+}
+
+func (s *ClipServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := parseClipRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.PreRoll = s.PreRoll
+	req.Profile = s.Profile
+
+	clipError := func(err error) {
+		code := http.StatusInternalServerError
+		if errors.Is(err, video.ErrNoFootage) {
+			code = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), code)
+	}
+
+	if r.Form.Get("save") != "" {
+		if r.Method != "POST" {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		vr, err := s.FS.SaveClip(r.Context(), req, s.Jobs)
+		if err != nil {
+			clipError(err)
+			return
+		}
+		writeJSON(w, toMetaEntry(vr))
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "clip")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "clip.mp4")
+	sources, err := s.FS.Clip(r.Context(), req, p)
+	if err != nil {
+		clipError(err)
+		return
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	log.Infof("Serving clip cut from %d events", len(sources))
+
+	name := fmt.Sprintf("clip-%s.mp4", sources[0].Identifier)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", name))
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, name, time.Time{}, f)
+}
@@ -0,0 +1,58 @@
+package serve
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"cam/video"
+)
+
+func TestParseClipRequest(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  *video.ClipRequest // nil if the request is invalid.
+	}{
+		{"id=a", &video.ClipRequest{Identifier: "a"}},
+		{"id=a&start=1.5&end=3", &video.ClipRequest{Identifier: "a", Start: 1500 * time.Millisecond, End: 3 * time.Second}},
+		{"id=a&start=2", &video.ClipRequest{Identifier: "a", Start: 2 * time.Second}},
+		{"id=a&exact=1&timestamp=true", &video.ClipRequest{Identifier: "a", Exact: true, Timestamp: true}},
+		{"from=1662033600&to=1662033660.5", &video.ClipRequest{
+			From: time.Unix(1662033600, 0),
+			To:   time.Unix(1662033660, 5e8),
+		}},
+
+		{"id=a&start=3&end=2", nil},
+		{"id=a&start=2&end=2", nil},
+		{"id=a&start=-1", nil},
+		{"id=a&end=x", nil},
+		{"id=a&exact=maybe", nil},
+		{"", nil},
+		{"from=1662033600", nil},
+		{"from=1662033660&to=1662033600", nil},
+	} {
+		r := httptest.NewRequest("GET", "/clip?"+tc.query, nil)
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		got, err := parseClipRequest(r)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("%q: got %+v, want an error", tc.query, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tc.query, err)
+			continue
+		}
+		if !got.From.Equal(tc.want.From) || !got.To.Equal(tc.want.To) {
+			t.Errorf("%q: got range %v to %v, want %v to %v", tc.query, got.From, got.To, tc.want.From, tc.want.To)
+		}
+		got.From, got.To = tc.want.From, tc.want.To
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %+v, want %+v", tc.query, got, tc.want)
+		}
+	}
+}
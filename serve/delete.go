@@ -4,8 +4,11 @@ import (
 	"cam/video"
 	"fmt"
 	"net/http"
+	"strconv"
 )
 
+// DeleteServer moves an event to the trash. If "permanent" is set, the event
+// is deleted immediately instead, whether or not it is already in the trash.
 type DeleteServer struct {
 	FS *video.Filesystem
 }
@@ -21,12 +24,30 @@ func (s *DeleteServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var permanent bool
+	if v := r.Form.Get("permanent"); v != "" {
+		var err error
+		if permanent, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for permanent: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
 	id := r.Form.Get("id")
 	vr := s.FS.GetRecordByID(id)
+	if vr == nil && permanent {
+		vr = s.FS.GetTrashedRecordByID(id)
+	}
 	if vr == nil {
 		http.Error(w, fmt.Sprintf("No record found for id %v", id), http.StatusNotFound)
 		return
 	}
 
-	vr.Delete()
+	if permanent {
+		vr.Delete()
+		return
+	}
+	if err := vr.Trash(); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
 }
@@ -0,0 +1,176 @@
+package serve
+
+import (
+	"archive/zip"
+	"cam/config"
+	"cam/evidence"
+	"cam/video"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// EvidenceManifest describes an exported video. It is signed, and includes
+// the video hash, so the signature covers the video too.
+type EvidenceManifest struct {
+	Event  *MetaEntry
+	Camera string
+
+	// File is the name of the video in the bundle, and SHA256 its hash at
+	// export. RecordedSHA256 is the hash recorded when the video was
+	// finalized, which matches unless it is empty: bundles are not exported
+	// for modified videos.
+	File           string
+	SHA256         string
+	RecordedSHA256 string
+
+	IntegrityCheckedAt *time.Time `json:",omitempty"`
+	ExportedAt         time.Time
+}
+
+// EvidenceServer exports the event given by "id" as a ZIP bundle containing
+// the video, metadata.json describing it, metadata.json.sig with a detached
+// ed25519 signature of the metadata, and public_key.pem to verify it with.
+// Events which failed integrity verification are refused, as are videos which
+// no longer match their recorded hash, which are flagged.
+type EvidenceServer struct {
+	FS     *video.Filesystem
+	Signer *evidence.Signer
+}
+
+func (s *EvidenceServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.Form.Get("id")
+	vr := s.FS.GetRecordByID(id)
+	if vr == nil {
+		http.Error(w, fmt.Sprintf("No record found for id %v", id), http.StatusNotFound)
+		return
+	}
+	if !vr.HaveVideo || vr.Recording() {
+		http.Error(w, fmt.Sprintf("No finished video for id %v", id), http.StatusNotFound)
+		return
+	}
+	if vr.IntegrityFailed {
+		http.Error(w, fmt.Sprintf("Integrity check failed: %v", vr.IntegrityError), http.StatusConflict)
+		return
+	}
+
+	p := vr.Paths().VideoPath
+	f, err := vr.Open(r.Context(), p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	// Check the video before anything is sent, so that a modified video is
+	// never signed.
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if vr.VideoSHA256 != "" && sum != vr.VideoSHA256 {
+		problem := fmt.Sprintf("video modified: sha256 is %v, expected %v", sum, vr.VideoSHA256)
+		if err := vr.FlagIntegrity(problem); err != nil {
+			log.Errorf("Failed to flag %v: %v", vr.Identifier, err)
+		}
+		http.Error(w, fmt.Sprintf("Integrity check failed: %v", problem), http.StatusConflict)
+		return
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=evidence-%s.zip", vr.Identifier))
+
+	elog := log.WithField("addr", r.RemoteAddr)
+	zw := zip.NewWriter(w)
+	if err := s.writeBundle(zw, vr, path.Base(p), f, sum); err != nil {
+		// Headers are already sent; the client sees a truncated archive.
+		elog.Errorf("Evidence export of %v failed: %v", vr.Identifier, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		elog.Errorf("Evidence export of %v failed: %v", vr.Identifier, err)
+		return
+	}
+	elog.Infof("Exported evidence bundle for %v", vr.Identifier)
+}
+
+// writeBundle writes the bundle for a video with the given hash. The video is
+// hashed again as it is written, and nothing is signed if it changed.
+func (s *EvidenceServer) writeBundle(zw *zip.Writer, vr *video.VideoRecord, name string, f io.Reader, sum string) error {
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: vr.TriggeredAt,
+	})
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(fw, io.TeeReader(f, h)); err != nil {
+		return err
+	}
+
+	if written := hex.EncodeToString(h.Sum(nil)); written != sum {
+		return fmt.Errorf("video changed during export: sha256 is %v, expected %v", written, sum)
+	}
+
+	m := &EvidenceManifest{
+		Event:              toMetaEntry(vr),
+		Camera:             config.Get().GetCameraName(),
+		File:               name,
+		SHA256:             sum,
+		RecordedSHA256:     vr.VideoSHA256,
+		IntegrityCheckedAt: vr.IntegrityCheckedAt,
+		ExportedAt:         time.Now(),
+	}
+	js, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{"metadata.json", js},
+		{"metadata.json.sig", s.Signer.Sign(js)},
+		{"public_key.pem", []byte(s.Signer.Key.Public)},
+	} {
+		fw, err := zw.Create(file.name)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(file.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EvidenceKeyServer provides the public key used to sign evidence bundles.
+type EvidenceKeyServer struct {
+	Signer *evidence.Signer
+}
+
+func (s *EvidenceKeyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	io.WriteString(w, s.Signer.Key.Public)
+}
@@ -0,0 +1,110 @@
+package serve
+
+import (
+	"archive/zip"
+	"cam/video"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ExportServer streams a ZIP archive of the selected events (see
+// parseSelection), with their videos, thumbnails and a manifest.json of their
+// metadata. The archive is written as it is read, so its size is not known in
+// advance.
+type ExportServer struct {
+	FS *video.Filesystem
+}
+
+func (s *ExportServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseSelection(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	records := s.FS.GetRecords(filter)
+	if len(records) == 0 {
+		http.Error(w, "No events match the selection", http.StatusNotFound)
+		return
+	}
+
+	name := fmt.Sprintf("events-%s.zip", time.Now().Format(video.FileTimeLayout))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", name))
+
+	elog := log.WithField("addr", r.RemoteAddr)
+	zw := zip.NewWriter(w)
+	if err := writeExport(r, zw, records); err != nil {
+		// Headers are already sent; the client sees a truncated archive.
+		elog.Errorf("Export of %d events failed: %v", len(records), err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		elog.Errorf("Export of %d events failed: %v", len(records), err)
+		return
+	}
+	elog.Infof("Exported %d events", len(records))
+}
+
+func writeExport(r *http.Request, zw *zip.Writer, records []*video.VideoRecord) error {
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(mw)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(buildMetaResponse(records)); err != nil {
+		return err
+	}
+
+	for _, vr := range records {
+		if vr.Recording() {
+			continue
+		}
+		paths := vr.Paths()
+		var files []string
+		if vr.HaveVideo {
+			files = append(files, paths.VideoPath)
+		}
+		if vr.HaveThumb {
+			files = append(files, paths.ThumbPath)
+		}
+		for _, p := range files {
+			if err := addExportFile(r, zw, vr, p); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// addExportFile copies one file into the archive. Files which can't be opened
+// are skipped.
+func addExportFile(r *http.Request, zw *zip.Writer, vr *video.VideoRecord, p string) error {
+	f, err := vr.Open(r.Context(), p)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("Skipping %v in export: %v", p, err)
+		}
+		return nil
+	}
+	defer f.Close()
+
+	// Video and images are already compressed.
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     path.Base(p),
+		Method:   zip.Store,
+		Modified: vr.TriggeredAt,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(fw, f)
+	return err
+}
@@ -1,13 +1,18 @@
 package serve
 
 import (
+	"cam/config"
 	"cam/video"
+	"cam/video/storage"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
 // TODO limit read parallelism to avoid disk thrashing?
@@ -16,6 +21,10 @@ type FileServer struct {
 	FS          *video.Filesystem
 	PathFunc    func(r *video.VideoRecord) string
 	ContentType string
+
+	// If set, provides the file to serve while the record is still recording,
+	// or "" if there is none.
+	PartialPathFunc func(r *video.VideoRecord) string
 }
 
 func NewVideoServer(fs *video.Filesystem) *FileServer {
@@ -25,6 +34,9 @@ func NewVideoServer(fs *video.Filesystem) *FileServer {
 			return r.Paths().VideoPath
 		},
 		ContentType: "video/mp4",
+		PartialPathFunc: func(r *video.VideoRecord) string {
+			return r.PartialVideoPath()
+		},
 	}
 }
 
@@ -48,6 +60,26 @@ func NewVThumbServer(fs *video.Filesystem) *FileServer {
 	}
 }
 
+func NewSpriteServer(fs *video.Filesystem) *FileServer {
+	return &FileServer{
+		FS: fs,
+		PathFunc: func(r *video.VideoRecord) string {
+			return r.Paths().SpritePath
+		},
+		ContentType: "image/jpeg",
+	}
+}
+
+func NewVTTServer(fs *video.Filesystem) *FileServer {
+	return &FileServer{
+		FS: fs,
+		PathFunc: func(r *video.VideoRecord) string {
+			return r.Paths().VTTPath
+		},
+		ContentType: "text/vtt",
+	}
+}
+
 func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -56,6 +88,10 @@ func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	id := r.Form.Get("id")
 	vr := s.FS.GetRecordByID(id)
+	if vr == nil {
+		// Allow previewing events before restoring them from the trash.
+		vr = s.FS.GetTrashedRecordByID(id)
+	}
 	if vr == nil {
 		http.Error(w, fmt.Sprintf("No record found for id %v", id), http.StatusNotFound)
 		return
@@ -73,20 +109,61 @@ func (s *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	p := s.PathFunc(vr)
 
-	f, err := os.Open(p)
+	var f io.ReadSeekCloser
+	var lf *os.File
+	if s.PartialPathFunc != nil && vr.Recording() {
+		// Serve what has been written so far. Each request sees the current
+		// length of the file.
+		if pp := s.PartialPathFunc(vr); pp != "" {
+			lf, err = os.Open(pp)
+			w.Header().Set("Cache-Control", "no-store")
+		}
+	}
+	if lf == nil {
+		// Not recording, or recording finished since the check above.
+		lf, err = os.Open(p)
+	}
+	if err == nil {
+		f = lf
+	} else if os.IsNotExist(err) && vr.Offloaded {
+		// The local copy has been evicted; serve from remote storage. Encrypted
+		// files must pass through here to be decrypted.
+		if sc := config.Get().Storage; sc != nil && sc.Presign && !dl && !s.FS.Encrypts() {
+			expiry := time.Duration(sc.PresignExpirySec) * time.Second
+			if expiry == 0 {
+				expiry = time.Hour
+			}
+			u, uerr := vr.RemoteURL(r.Context(), p, expiry)
+			if uerr == nil {
+				http.Redirect(w, r, u, http.StatusFound)
+				return
+			}
+			if uerr != storage.ErrNotSupported {
+				log.Warnf("Failed to presign %v, streaming instead: %v", p, uerr)
+			}
+		}
+		f, err = vr.OpenRemote(r.Context(), p)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
 	}
+	// Encrypted files are decrypted on the fly; ranges are supported.
+	if f, err = vr.Decrypt(f); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	defer f.Close()
 
 	if dl {
-		fi, err := f.Stat()
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if pf, ok := f.(*os.File); ok && pf == lf {
+			fi, err := lf.Stat()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
 		}
-		w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
 		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", path.Base(p)))
 	}
 
@@ -0,0 +1,33 @@
+package serve
+
+import (
+	"cam/video"
+	"encoding/json"
+	"net/http"
+)
+
+// GCServer reports what garbage collection would remove (GET), or runs it
+// immediately (POST).
+type GCServer struct {
+	FS *video.Filesystem
+}
+
+func (s *GCServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var report *video.GCReport
+	switch r.Method {
+	case "GET":
+		report = s.FS.GarbageCollect(true)
+	case "POST":
+		report = s.FS.GarbageCollect(false)
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,62 @@
+package serve
+
+import (
+	"cam/video"
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// JobServer exposes the post-processing queue. GET lists outstanding and
+// failed jobs. POST with "retry=<job id>" retries a failed job, and POST with
+// "id=<event id>&kind=<kind>" queues a new job.
+type JobServer struct {
+	Jobs *video.JobQueue
+}
+
+func (s *JobServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if v := r.Form.Get("retry"); v != "" {
+			id, err := strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				http.Error(w, "bad retry", http.StatusBadRequest)
+				return
+			}
+			if err := s.Jobs.Retry(uint(id)); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+		} else {
+			switch kind := r.Form.Get("kind"); kind {
+			case video.JobVThumb, video.JobSprites, video.JobReencode, video.JobOffload, video.JobRetention:
+				if r.Form.Get("id") == "" {
+					http.Error(w, "missing id", http.StatusBadRequest)
+					return
+				}
+				s.Jobs.Enqueue(r.Form.Get("id"), kind)
+			default:
+				http.Error(w, "unknown kind", http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobs, err := s.Jobs.Jobs()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(jobs); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,80 @@
+package serve
+
+import (
+	"cam/video/sink"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// LiveServer streams live video as fragmented MP4 over a websocket, for
+// playback using Media Source Extensions. The first message is a JSON text
+// message containing the MIME type for the source buffer, followed by binary
+// messages holding the initialization segment and then media fragments.
+type LiveServer struct {
+	Stream *sink.FMP4Stream
+
+	upgrader websocket.Upgrader
+}
+
+func NewLiveServer(s *sink.FMP4Stream) *LiveServer {
+	return &LiveServer{
+		Stream:   s,
+		upgrader: newUpgrader(),
+	}
+}
+
+type liveStreamInfo struct {
+	MIME string
+}
+
+func (l *LiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ws, err := l.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		if _, ok := err.(websocket.HandshakeError); !ok {
+			log.WithField("addr", r.RemoteAddr).Errorf("Websocket handshake failed for live stream: %v", err)
+		}
+		return
+	}
+	go l.serve(ws)
+}
+
+func (l *LiveServer) serve(ws *websocket.Conn) {
+	clog := log.WithField("addr", ws.RemoteAddr())
+	clog.Info("connected to live stream socket")
+	defer func() {
+		ws.Close()
+		clog.Info("disconnected from live stream socket")
+	}()
+	pingTicker := time.NewTicker(pingPeriod)
+	defer pingTicker.Stop()
+
+	c := l.Stream.Subscribe()
+	defer l.Stream.Unsubscribe(c)
+
+	go discardIncoming(ws)
+
+	for {
+		select {
+		case f := <-c.C:
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if f.Init {
+				info, _ := json.Marshal(&liveStreamInfo{MIME: f.MIME})
+				if err := ws.WriteMessage(websocket.TextMessage, info); err != nil {
+					return
+				}
+			}
+			if err := ws.WriteMessage(websocket.BinaryMessage, f.Data); err != nil {
+				return
+			}
+		case <-pingTicker.C:
+			ws.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := ws.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -14,10 +14,36 @@ type MetaEntry struct {
 	HaveVideo  bool
 	HaveThumb  bool
 	HaveVThumb bool
+	HaveSprite bool
+	HaveVTT    bool
+
+	// Recording is set while video is still being written. PartialVideo is
+	// also set if the video written so far is available for playback.
+	Recording    bool
+	PartialVideo bool
 
 	DurationSec int
 
+	// Pinned events are exempt from garbage collection.
+	Pinned bool
+
+	// User-editable metadata.
+	Favorite bool
+	Tags     []string          `json:",omitempty"`
+	Notes    []video.EventNote `json:",omitempty"`
+
 	Detection *process.Detection
+
+	// TrashedTimestamp is when the event was moved to the trash, if it was.
+	TrashedTimestamp int64 `json:",omitempty"`
+
+	// Error describes a recording failure, if any.
+	Error string `json:",omitempty"`
+
+	// SHA256 is the hash of the video recorded when it was finalized.
+	// IntegrityError is set if the video no longer matches or is unreadable.
+	SHA256         string `json:",omitempty"`
+	IntegrityError string `json:",omitempty"`
 }
 
 type MetaResponse struct {
@@ -35,7 +61,24 @@ func toMetaEntry(r *video.VideoRecord) *MetaEntry {
 		HaveVideo:   r.HaveVideo,
 		HaveThumb:   r.HaveThumb,
 		HaveVThumb:  r.HaveVThumb,
+		HaveSprite:  r.HaveSprite,
+		HaveVTT:     r.HaveVTT,
+		Recording:   r.Recording(),
 		DurationSec: r.VideoDurationSec,
+		Pinned:      r.Pinned,
+		Favorite:    r.Favorite,
+		Tags:        r.Tags,
+		Notes:       r.Notes,
+		Error:       r.ErrorMessage,
+
+		SHA256:         r.VideoSHA256,
+		IntegrityError: r.IntegrityError,
+	}
+	if me.Recording {
+		me.PartialVideo = r.PartialVideoPath() != ""
+	}
+	if r.Trashed() {
+		me.TrashedTimestamp = r.DeletedAt.Time.Unix()
 	}
 	if r.Classification != nil && len(r.Classification.Detections) > 0 {
 		me.Detection = &r.Classification.Detections[0]
@@ -48,8 +91,10 @@ type MetaServer struct {
 }
 
 func (s *MetaServer) BuildResponse(filter *video.RecordsFilter) *MetaResponse {
-	records := s.FS.GetRecords(filter)
+	return buildMetaResponse(s.FS.GetRecords(filter))
+}
 
+func buildMetaResponse(records []*video.VideoRecord) *MetaResponse {
 	resp := &MetaResponse{}
 	var sz int64
 	for _, r := range records {
@@ -69,6 +114,8 @@ func (s *MetaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	opts := &video.RecordsFilter{
 		HaveClassification: r.Form.Get("have_classification") != "",
+		Favorite:           r.Form.Get("favorite") != "",
+		Tags:               r.Form["tag"],
 	}
 	js, err := json.Marshal(s.BuildResponse(opts))
 	if err != nil {
@@ -23,16 +23,32 @@ type MetaUpdater struct {
 	notify   chan bool
 }
 
+func newUpgrader() websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	}
+}
+
+// discardIncoming reads from the socket until it is closed. Even though we
+// don't care about incoming messages, we need to read from the socket in order
+// to process control messages.
+func discardIncoming(ws *websocket.Conn) {
+	for {
+		if _, _, err := ws.NextReader(); err != nil {
+			ws.Close()
+			return
+		}
+	}
+}
+
 func NewMetaUpdater() *MetaUpdater {
 	m := &MetaUpdater{
-		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
-		},
-		cs:     make(map[chan bool]bool),
-		addc:   make(chan chan bool),
-		delc:   make(chan chan bool),
-		notify: make(chan bool),
+		upgrader: newUpgrader(),
+		cs:       make(map[chan bool]bool),
+		addc:     make(chan chan bool),
+		delc:     make(chan chan bool),
+		notify:   make(chan bool),
 	}
 	go func() {
 		for {
@@ -85,16 +101,7 @@ func (m *MetaUpdater) serve(ws *websocket.Conn) {
 	m.addc <- notifyc
 	defer func() { m.delc <- notifyc }()
 
-	// Even though we don't care about incoming messages, we need to read from
-	// the socket in order to process control messages.
-	go func() {
-		for {
-			if _, _, err := ws.NextReader(); err != nil {
-				ws.Close()
-				return
-			}
-		}
-	}()
+	go discardIncoming(ws)
 
 	for {
 		select {
@@ -0,0 +1,20 @@
+package serve
+
+import (
+	"cam/video/sink"
+	"encoding/json"
+	"net/http"
+)
+
+// MJPEGDirectoryServer lists the available MJPEG streams.
+type MJPEGDirectoryServer struct {
+	Server *sink.MJPEGServer
+}
+
+func (s *MJPEGDirectoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(s.Server.Streams()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,44 @@
+package serve
+
+import (
+	"cam/video"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// PinServer sets whether an event is exempt from garbage collection. The
+// "pinned" parameter defaults to true.
+type PinServer struct {
+	FS *video.Filesystem
+}
+
+func (s *PinServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pinned := true
+	if v := r.Form.Get("pinned"); v != "" {
+		var err error
+		if pinned, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid value for pinned: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	id := r.Form.Get("id")
+	vr := s.FS.GetRecordByID(id)
+	if vr == nil {
+		http.Error(w, fmt.Sprintf("No record found for id %v", id), http.StatusNotFound)
+		return
+	}
+
+	vr.SetPinned(pinned)
+}
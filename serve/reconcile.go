@@ -0,0 +1,33 @@
+package serve
+
+import (
+	"cam/video"
+	"encoding/json"
+	"net/http"
+)
+
+// ReconcileServer runs a filesystem consistency check on demand.
+type ReconcileServer struct {
+	FS   *video.Filesystem
+	Jobs *video.JobQueue
+}
+
+func (s *ReconcileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report, err := s.FS.Reconcile(s.Jobs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,63 @@
+package serve
+
+import (
+	"cam/video"
+	"fmt"
+	"net/http"
+)
+
+// TrashServer lists the events in the trash, most recently trashed first.
+type TrashServer struct {
+	FS *video.Filesystem
+}
+
+func (s *TrashServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, buildMetaResponse(s.FS.GetTrash()))
+}
+
+// RestoreServer takes the event given by "id" out of the trash.
+type RestoreServer struct {
+	FS *video.Filesystem
+}
+
+func (s *RestoreServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := r.Form.Get("id")
+	vr := s.FS.GetTrashedRecordByID(id)
+	if vr == nil {
+		http.Error(w, fmt.Sprintf("No trashed record found for id %v", id), http.StatusNotFound)
+		return
+	}
+
+	if err := vr.Restore(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// EmptyTrashServer permanently deletes every event in the trash, and reports
+// how many were deleted.
+type EmptyTrashServer struct {
+	FS *video.Filesystem
+}
+
+func (s *EmptyTrashServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, struct{ Deleted int }{s.FS.EmptyTrash()})
+}
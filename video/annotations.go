@@ -0,0 +1,197 @@
+package video
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxTagLength is the longest tag name accepted.
+const MaxTagLength = 64
+
+// ErrInvalidTag is returned for tag names which are empty or too long.
+var ErrInvalidTag = errors.New("tag must be between 1 and 64 characters")
+
+// EventTag labels an event, e.g. "delivery" or "false alarm". Names are
+// normalized by NormalizeTag.
+type EventTag struct {
+	ID         uint   `gorm:"primarykey"`
+	Identifier string `gorm:"type:varchar(100);uniqueIndex:idx_event_tag"`
+	Name       string `gorm:"type:varchar(64);uniqueIndex:idx_event_tag;index"`
+}
+
+// EventNote is free text attached to an event by a user.
+type EventNote struct {
+	ID         uint   `gorm:"primarykey"`
+	Identifier string `gorm:"type:varchar(100);index" json:"-"`
+	CreatedAt  time.Time
+	Text       string `gorm:"type:text"`
+}
+
+// NormalizeTag trims and lower-cases a tag name so that tags compare equal
+// regardless of how they were typed.
+func NormalizeTag(name string) (string, error) {
+	name = strings.ToLower(strings.Join(strings.Fields(name), " "))
+	if name == "" || len(name) > MaxTagLength {
+		return "", ErrInvalidTag
+	}
+	return name, nil
+}
+
+// SetFavorite stars or unstars the record.
+func (r *VideoRecord) SetFavorite(favorite bool) {
+	defer r.fs.notifyListeners()
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.Favorite = favorite
+	if err := r.fs.db.Debug().Model(r).Update("favorite", favorite).Error; err != nil {
+		log.Errorf("SetFavorite %v for %v", err, r.Identifier)
+	}
+}
+
+// AddTag applies a tag to the record. Adding a tag twice has no effect.
+func (r *VideoRecord) AddTag(name string) error {
+	name, err := NormalizeTag(name)
+	if err != nil {
+		return err
+	}
+	defer r.fs.notifyListeners()
+	t := &EventTag{Identifier: r.Identifier, Name: name}
+	if err := r.fs.db.Clauses(clause.OnConflict{DoNothing: true}).Create(t).Error; err != nil {
+		return err
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	for _, n := range r.Tags {
+		if n == name {
+			return nil
+		}
+	}
+	r.Tags = append(r.Tags, name)
+	sort.Strings(r.Tags)
+	return nil
+}
+
+// RemoveTag removes a tag from the record, if present.
+func (r *VideoRecord) RemoveTag(name string) error {
+	name, err := NormalizeTag(name)
+	if err != nil {
+		return err
+	}
+	defer r.fs.notifyListeners()
+	if err := r.fs.db.Where("identifier = ? AND name = ?", r.Identifier, name).Delete(&EventTag{}).Error; err != nil {
+		return err
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	for i, n := range r.Tags {
+		if n == name {
+			r.Tags = append(r.Tags[:i], r.Tags[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// AddNote attaches a note to the record.
+func (r *VideoRecord) AddNote(text string) (*EventNote, error) {
+	defer r.fs.notifyListeners()
+	n := &EventNote{Identifier: r.Identifier, Text: text}
+	if err := r.fs.db.Create(n).Error; err != nil {
+		return nil, err
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.Notes = append(r.Notes, *n)
+	return n, nil
+}
+
+// DeleteNote removes a note from the record. It returns
+// gorm.ErrRecordNotFound if the note does not belong to the record.
+func (r *VideoRecord) DeleteNote(id uint) error {
+	res := r.fs.db.Where("identifier = ? AND id = ?", r.Identifier, id).Delete(&EventNote{})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	defer r.fs.notifyListeners()
+	r.l.Lock()
+	defer r.l.Unlock()
+	for i, n := range r.Notes {
+		if n.ID == id {
+			r.Notes = append(r.Notes[:i], r.Notes[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// deleteAnnotations removes the tags and notes of a record being deleted.
+func (r *VideoRecord) deleteAnnotations() {
+	if err := r.fs.db.Where("identifier = ?", r.Identifier).Delete(&EventTag{}).Error; err != nil {
+		log.Errorf("Failed to remove tags for %v: %v", r.Identifier, err)
+	}
+	if err := r.fs.db.Where("identifier = ?", r.Identifier).Delete(&EventNote{}).Error; err != nil {
+		log.Errorf("Failed to remove notes for %v: %v", r.Identifier, err)
+	}
+}
+
+// loadAnnotations fills in the tags and notes of the given records.
+func (f *Filesystem) loadAnnotations(records []*VideoRecord) {
+	if len(records) == 0 {
+		return
+	}
+	byID := make(map[string]*VideoRecord, len(records))
+	ids := make([]string, 0, len(records))
+	for _, r := range records {
+		byID[r.Identifier] = r
+		ids = append(ids, r.Identifier)
+	}
+
+	var tags []EventTag
+	if err := f.db.Where("identifier IN ?", ids).Order("name").Find(&tags).Error; err != nil {
+		log.Errorf("Tag lookup failed: %v", err)
+	}
+	for _, t := range tags {
+		if r := byID[t.Identifier]; r != nil {
+			r.Tags = append(r.Tags, t.Name)
+		}
+	}
+
+	var notes []EventNote
+	if err := f.db.Where("identifier IN ?", ids).Order("created_at").Find(&notes).Error; err != nil {
+		log.Errorf("Note lookup failed: %v", err)
+	}
+	for _, n := range notes {
+		if r := byID[n.Identifier]; r != nil {
+			r.Notes = append(r.Notes, n)
+		}
+	}
+}
+
+// TagCount is the number of events with a given tag.
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+// TagCounts lists every tag in use, most used first.
+func (f *Filesystem) TagCounts() []TagCount {
+	var counts []TagCount
+	err := f.db.Model(&EventTag{}).
+		Select("name, count(*) AS count").
+		Group("name").
+		Order("count DESC, name").
+		Scan(&counts).Error
+	if err != nil {
+		log.Errorf("Tag count failed: %v", err)
+	}
+	return counts
+}
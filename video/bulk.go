@@ -0,0 +1,36 @@
+package video
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// BulkResult summarizes an operation applied to several records. Failed maps
+// event identifiers to the error encountered.
+type BulkResult struct {
+	Matched int
+	Updated int
+	Failed  map[string]string `json:",omitempty"`
+}
+
+// UpdateRecords applies fn to each record, notifying listeners once at the end
+// rather than for every record.
+func (f *Filesystem) UpdateRecords(records []*VideoRecord, fn func(r *VideoRecord) error) *BulkResult {
+	ne := f.notifyListenersInBatch()
+	defer func() {
+		ne <- true
+	}()
+
+	res := &BulkResult{Matched: len(records)}
+	for _, r := range records {
+		if err := fn(r); err != nil {
+			if res.Failed == nil {
+				res.Failed = make(map[string]string)
+			}
+			res.Failed[r.Identifier] = err.Error()
+			continue
+		}
+		res.Updated++
+	}
+	log.Infof("Bulk update of %d events: %d updated, %d failed", res.Matched, res.Updated, len(res.Failed))
+	return res
+}
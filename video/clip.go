@@ -0,0 +1,281 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"cam/config"
+	"cam/video/process"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MaxClipDuration bounds the length of a trimmed clip.
+	MaxClipDuration = 30 * time.Minute
+
+	// clipLookback is how long before a range to look for events which may
+	// cover its start. Events are assumed to be shorter than this.
+	clipLookback = time.Hour
+)
+
+// ErrNoFootage indicates that no local video covers the requested clip.
+var ErrNoFootage = errors.New("no recorded video for the requested clip")
+
+// ClipRequest describes a clip to cut from recorded footage: either part of a
+// single event, given by Identifier and offsets into its video, or a wall
+// clock range across consecutive events, given by From and To.
+type ClipRequest struct {
+	Identifier string
+	// A zero End includes the rest of the video.
+	Start, End time.Duration
+
+	From, To time.Time
+
+	// PreRoll is how long before its trigger time each event's video starts,
+	// used to map wall clock times to offsets.
+	PreRoll time.Duration
+
+	// Exact re-encodes using Profile for frame-accurate cuts. Timestamp burns
+	// the wall clock time into the video, and also re-encodes.
+	Exact     bool
+	Timestamp bool
+	Profile   config.EncodingProfile
+}
+
+// clippable reports whether r has complete local video.
+func (r *VideoRecord) clippable() bool {
+	return r.HaveVideo && !r.LocalEvicted && !r.Recording()
+}
+
+// videoStart returns the wall clock time of the first frame of the video.
+// Events start preRoll before they were triggered, unless the record says
+// otherwise, as saved clips do.
+func (r *VideoRecord) videoStart(preRoll time.Duration) time.Time {
+	if r.VideoStartedAt != nil {
+		return *r.VideoStartedAt
+	}
+	return r.TriggeredAt.Add(-preRoll)
+}
+
+// clipSources finds the video to include in a clip, and the wall clock time
+// of its first frame.
+func (f *Filesystem) clipSources(req *ClipRequest) ([]process.TrimInput, []*VideoRecord, time.Time, error) {
+	if req.Identifier != "" {
+		r := f.GetRecordByID(req.Identifier)
+		if r == nil || !r.clippable() {
+			return nil, nil, time.Time{}, ErrNoFootage
+		}
+		end := req.End
+		if end == 0 {
+			end = time.Duration(r.VideoDurationSec) * time.Second
+		}
+		if end-req.Start > MaxClipDuration {
+			return nil, nil, time.Time{}, fmt.Errorf("clip is longer than %v", MaxClipDuration)
+		}
+		in := process.TrimInput{Path: r.Paths().VideoPath, Start: req.Start, End: req.End}
+		start := r.videoStart(req.PreRoll).Add(req.Start)
+		return []process.TrimInput{in}, []*VideoRecord{r}, start, nil
+	}
+
+	if req.To.Sub(req.From) > MaxClipDuration {
+		return nil, nil, time.Time{}, fmt.Errorf("clip is longer than %v", MaxClipDuration)
+	}
+	records := f.GetRecords(&RecordsFilter{
+		After:  req.From.Add(-clipLookback),
+		Before: req.To.Add(req.PreRoll),
+	})
+	return rangeSources(req, records)
+}
+
+// rangeSources stitches together the parts of records which cover the
+// requested range.
+func rangeSources(req *ClipRequest, records []*VideoRecord) ([]process.TrimInput, []*VideoRecord, time.Time, error) {
+	var usable []*VideoRecord
+	for _, r := range records {
+		if r.clippable() {
+			usable = append(usable, r)
+		}
+	}
+	// Earliest video first; consecutive events may overlap by up to the
+	// pre-roll, and saved clips overlap the events they were cut from.
+	sort.SliceStable(usable, func(i, j int) bool {
+		return usable[i].videoStart(req.PreRoll).Before(usable[j].videoStart(req.PreRoll))
+	})
+
+	var inputs []process.TrimInput
+	var sources []*VideoRecord
+	var start time.Time
+	covered := req.From
+	for _, r := range usable {
+		vstart := r.videoStart(req.PreRoll)
+		vend := vstart.Add(time.Duration(r.VideoDurationSec) * time.Second)
+		if !vend.After(covered) || !vstart.Before(req.To) {
+			continue
+		}
+		from := covered
+		if vstart.After(from) {
+			from = vstart
+		}
+		in := process.TrimInput{Path: r.Paths().VideoPath, Start: from.Sub(vstart)}
+		if vend.After(req.To) {
+			in.End = req.To.Sub(vstart)
+		}
+		if len(inputs) == 0 {
+			start = from
+		}
+		inputs = append(inputs, in)
+		sources = append(sources, r)
+		covered = vend
+	}
+	if len(inputs) == 0 {
+		return nil, nil, time.Time{}, ErrNoFootage
+	}
+	return inputs, sources, start, nil
+}
+
+// plainInputs points the inputs at the plaintext of their videos. done removes
+// any decrypted copies.
+func (f *Filesystem) plainInputs(inputs []process.TrimInput) (done func(), err error) {
+	var cleanups []func()
+	done = func() {
+		for _, c := range cleanups {
+			c()
+		}
+	}
+	for i := range inputs {
+		plain, cleanup, err := f.plainPath(inputs[i].Path)
+		if err != nil {
+			done()
+			return nil, err
+		}
+		cleanups = append(cleanups, cleanup)
+		inputs[i].Path = plain
+	}
+	return done, nil
+}
+
+func (req *ClipRequest) trimOptions(start time.Time) process.TrimOptions {
+	opts := process.TrimOptions{
+		Exact:   req.Exact,
+		Profile: req.Profile,
+	}
+	if req.Timestamp {
+		opts.Timestamp = start
+	}
+	return opts
+}
+
+// Clip writes the requested clip to dst, and returns the events it was cut
+// from.
+func (f *Filesystem) Clip(ctx context.Context, req *ClipRequest, dst string) ([]*VideoRecord, error) {
+	inputs, sources, start, err := f.clipSources(req)
+	if err != nil {
+		return nil, err
+	}
+	done, err := f.plainInputs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return sources, process.Trim(ctx, inputs, dst, req.trimOptions(start))
+}
+
+// SaveClip cuts the requested clip into a new pinned record, which carries
+// over the detections and tags of the events it was cut from. If jobs is set,
+// previews are scheduled for the new record.
+func (f *Filesystem) SaveClip(ctx context.Context, req *ClipRequest, jobs *JobQueue) (*VideoRecord, error) {
+	inputs, sources, start, err := f.clipSources(req)
+	if err != nil {
+		return nil, err
+	}
+	done, err := f.plainInputs(inputs)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	r, err := f.newClipRecord(start)
+	if err != nil {
+		return nil, err
+	}
+	paths := r.Paths()
+	if err := process.Trim(ctx, inputs, paths.VideoPath, req.trimOptions(start)); err != nil {
+		f.setRecording(r.Identifier, false)
+		r.Delete()
+		return nil, err
+	}
+
+	if err := process.ExtractThumb(paths.VideoPath, paths.ThumbPath); err != nil {
+		log.Errorf("Failed to generate thumbnail for clip %v: %v", r.Identifier, err)
+	} else {
+		r.UpdateThumb()
+	}
+
+	detections := make(process.Detections)
+	var ids []string
+	for _, s := range sources {
+		ids = append(ids, s.Identifier)
+		if s.Classification != nil {
+			for _, d := range s.Classification.Detections {
+				detections.Merge(process.Detections{d.Class: d.Confidence})
+			}
+		}
+		for _, t := range s.Tags {
+			if err := r.AddTag(t); err != nil {
+				log.Warnf("Failed to copy tag %q to clip %v: %v", t, r.Identifier, err)
+			}
+		}
+	}
+	r.UpdateVideo(detections.SortedDetections())
+	if _, err := r.AddNote("Clip of " + strings.Join(ids, ", ")); err != nil {
+		log.Warnf("Failed to add note to clip %v: %v", r.Identifier, err)
+	}
+
+	if jobs != nil {
+		jobs.Enqueue(r.Identifier, JobVThumb)
+		jobs.Enqueue(r.Identifier, JobSprites)
+		if f.HasRemote() {
+			jobs.Enqueue(r.Identifier, JobOffload)
+		}
+	}
+	log.Infof("Saved clip %v from %v", r.Identifier, ids)
+	return r, nil
+}
+
+// newClipRecord creates a pinned record for a clip starting at t. Identifiers
+// have a resolution of one second, and the source event usually has the same
+// start time, so the identifier is moved later until it is unused.
+func (f *Filesystem) newClipRecord(t time.Time) (*VideoRecord, error) {
+	idTime := t
+	for {
+		id := idTime.Format(FileTimeLayout)
+		var n int64
+		err := f.db.Unscoped().Model(&VideoRecord{}).Where("identifier = ?", id).Count(&n).Error
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 && !f.isRecording(id) {
+			break
+		}
+		idTime = idTime.Add(time.Second)
+	}
+
+	r := &VideoRecord{
+		TriggeredAt:    t,
+		VideoStartedAt: &t,
+		Identifier:     idTime.Format(FileTimeLayout),
+		Pinned:         true,
+		fs:             f,
+	}
+	if err := f.db.Debug().Create(r).Error; err != nil {
+		return nil, err
+	}
+	// Keep maintenance away until the video is complete.
+	f.setRecording(r.Identifier, true)
+	return r, nil
+}
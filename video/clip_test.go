@@ -0,0 +1,119 @@
+package video
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"cam/video/process"
+)
+
+func TestRangeSources(t *testing.T) {
+	f := newTestFilesystem(FilesystemOptions{BasePath: "/videos"})
+	t0 := gcNow
+	event := func(id string, triggered time.Duration, duration int) *VideoRecord {
+		return &VideoRecord{
+			Identifier:       id,
+			TriggeredAt:      t0.Add(triggered),
+			VideoDurationSec: duration,
+			HaveVideo:        true,
+			fs:               f,
+		}
+	}
+	path := func(id string) string { return "/videos/" + id + ExtVideo }
+	const preRoll = 10 * time.Second
+
+	// With the pre-roll, a covers t0-10s to t0+50s, and b t0+30s to t0+90s.
+	a := event("a", 0, 60)
+	b := event("b", 40*time.Second, 60)
+	later := event("later", 200*time.Second, 60)
+	noVideo := event("novideo", 0, 60)
+	noVideo.HaveVideo = false
+	evicted := event("evicted", 0, 60)
+	evicted.LocalEvicted = true
+	recording := event("recording", 0, 60)
+	f.setRecording("recording", true)
+	// Saved clips start at their trigger time, without a pre-roll.
+	clip := event("clip", 100*time.Second, 30)
+	clip.VideoStartedAt = &clip.TriggeredAt
+
+	for _, tc := range []struct {
+		name     string
+		from, to time.Duration
+		records  []*VideoRecord // Newest first.
+		want     []process.TrimInput
+		start    time.Duration
+	}{
+		{
+			name:    "overlapping events",
+			from:    0,
+			to:      80 * time.Second,
+			records: []*VideoRecord{later, b, a},
+			want: []process.TrimInput{
+				{Path: path("a"), Start: 10 * time.Second},
+				{Path: path("b"), Start: 20 * time.Second, End: 50 * time.Second},
+			},
+		},
+		{
+			name:    "starts in a gap",
+			from:    -time.Minute,
+			to:      40 * time.Second,
+			records: []*VideoRecord{a},
+			want:    []process.TrimInput{{Path: path("a"), End: 50 * time.Second}},
+			start:   -preRoll,
+		},
+		{
+			name:    "unusable events are skipped",
+			from:    0,
+			to:      80 * time.Second,
+			records: []*VideoRecord{b, recording, evicted, noVideo},
+			want:    []process.TrimInput{{Path: path("b"), End: 50 * time.Second}},
+			start:   30 * time.Second,
+		},
+		{
+			name:    "saved clip",
+			from:    95 * time.Second,
+			to:      120 * time.Second,
+			records: []*VideoRecord{later, clip, b},
+			want:    []process.TrimInput{{Path: path("clip"), End: 20 * time.Second}},
+			start:   100 * time.Second,
+		},
+		{
+			name:    "no footage",
+			from:    95 * time.Second,
+			to:      150 * time.Second,
+			records: []*VideoRecord{later, b, a},
+		},
+	} {
+		req := &ClipRequest{From: t0.Add(tc.from), To: t0.Add(tc.to), PreRoll: preRoll}
+		inputs, sources, start, err := rangeSources(req, tc.records)
+		if tc.want == nil {
+			if !errors.Is(err, ErrNoFootage) {
+				t.Errorf("%s: got %v, want ErrNoFootage", tc.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(inputs, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, inputs, tc.want)
+		}
+		if len(sources) != len(inputs) {
+			t.Errorf("%s: %d sources for %d inputs", tc.name, len(sources), len(inputs))
+		}
+		if want := t0.Add(tc.start); !start.Equal(want) {
+			t.Errorf("%s: starts at %v, want %v", tc.name, start, want)
+		}
+	}
+}
+
+func TestClipSourcesTooLong(t *testing.T) {
+	f := newTestFilesystem(FilesystemOptions{})
+	req := &ClipRequest{From: gcNow, To: gcNow.Add(MaxClipDuration + time.Second)}
+	if _, _, _, err := f.clipSources(req); err == nil {
+		t.Error("clip longer than MaxClipDuration was accepted")
+	}
+}
@@ -0,0 +1,431 @@
+// Package crypt encrypts files at rest in a seekable format, so that ranges
+// can be served without decrypting whole files.
+//
+// An encrypted file is a header followed by chunks of up to ChunkSize bytes of
+// plaintext, each sealed with AES-256-GCM. The header holds a magic string,
+// the ID of the key used and a random nonce prefix. Each chunk's nonce is the
+// prefix, the chunk index and a flag marking the final chunk, so chunks can't
+// be reordered or the file truncated without detection.
+package crypt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"cam/config"
+)
+
+const (
+	// ChunkSize is the amount of plaintext sealed at once.
+	ChunkSize = 64 * 1024
+
+	// KeySize is the length of keys in bytes.
+	KeySize = 32
+
+	magic       = "CAMENC\x00\x01"
+	prefixSize  = 7
+	headerSize  = len(magic) + 4 + prefixSize
+	overhead    = 16 // GCM tag
+	sealedChunk = ChunkSize + overhead
+
+	// tempSuffix matches the extension used for other temporary files, which
+	// are cleaned up by reconciliation.
+	tempSuffix = ".crypt.temp"
+)
+
+var (
+	// ErrCorrupt indicates a file failed authentication: it was modified,
+	// truncated or is otherwise damaged.
+	ErrCorrupt = errors.New("encrypted file is corrupt")
+
+	// ErrUnknownKey indicates a file was encrypted with a key which is not in
+	// the keyring.
+	ErrUnknownKey = errors.New("file encrypted with an unknown key")
+)
+
+// Key is a single AES-256 key, identified by a hash of its value.
+type Key struct {
+	ID   uint32
+	aead cipher.AEAD
+}
+
+// ParseKey decodes a base64 encoded 256-bit key.
+func ParseKey(s string) (*Key, error) {
+	raw, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	if len(raw) != KeySize {
+		return nil, fmt.Errorf("invalid encryption key: must be %d bytes, got %d", KeySize, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(raw)
+	return &Key{ID: binary.BigEndian.Uint32(sum[:4]), aead: aead}, nil
+}
+
+// Keyring holds the key used to encrypt new files, and previous keys which
+// can still decrypt old files.
+type Keyring struct {
+	current *Key
+	keys    map[uint32]*Key
+}
+
+// KeyEnv is the environment variable holding the key if it is not set in the
+// configuration.
+const KeyEnv = "CAM_ENCRYPTION_KEY"
+
+// New creates the keyring described by the configuration, or returns nil if
+// encryption is disabled. cfg may be nil.
+func New(cfg *config.EncryptionConfig) (*Keyring, error) {
+	if cfg == nil {
+		cfg = &config.EncryptionConfig{}
+	}
+	current := cfg.Key
+	if current == "" {
+		current = os.Getenv(KeyEnv)
+	}
+	if current == "" {
+		if len(cfg.PreviousKeys) > 0 {
+			return nil, errors.New("previous encryption keys are set without a current key")
+		}
+		return nil, nil
+	}
+	key, err := ParseKey(current)
+	if err != nil {
+		return nil, err
+	}
+	var previous []*Key
+	for _, s := range cfg.PreviousKeys {
+		p, err := ParseKey(s)
+		if err != nil {
+			return nil, err
+		}
+		previous = append(previous, p)
+	}
+	return NewKeyring(key, previous...), nil
+}
+
+func NewKeyring(current *Key, previous ...*Key) *Keyring {
+	k := &Keyring{
+		current: current,
+		keys:    map[uint32]*Key{current.ID: current},
+	}
+	for _, p := range previous {
+		k.keys[p.ID] = p
+	}
+	return k
+}
+
+type header struct {
+	raw    []byte
+	keyID  uint32
+	prefix []byte
+}
+
+// readHeader returns the header of an encrypted file, or nil if the file is
+// not encrypted. The reader is left positioned at the start.
+func readHeader(rs io.ReadSeeker) (*header, error) {
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	raw := make([]byte, headerSize)
+	n, err := io.ReadFull(rs, raw)
+	if _, serr := rs.Seek(0, io.SeekStart); serr != nil {
+		return nil, serr
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, nil // Too short to be encrypted.
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(raw[:len(magic)], []byte(magic)) {
+		return nil, nil
+	}
+	return &header{
+		raw:    raw[:n],
+		keyID:  binary.BigEndian.Uint32(raw[len(magic):]),
+		prefix: raw[len(magic)+4:],
+	}, nil
+}
+
+// IsEncrypted returns whether the file at p is encrypted.
+func IsEncrypted(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h, err := readHeader(f)
+	return h != nil, err
+}
+
+func nonce(prefix []byte, index uint32, final bool) []byte {
+	n := make([]byte, 12)
+	copy(n, prefix)
+	binary.BigEndian.PutUint32(n[prefixSize:], index)
+	if final {
+		n[11] = 1
+	}
+	return n
+}
+
+// writer seals plaintext in chunks. A full chunk is only sealed once more data
+// arrives, so that Close knows which chunk is final.
+type writer struct {
+	w     io.Writer
+	key   *Key
+	h     *header
+	buf   []byte
+	index uint32
+}
+
+// NewWriter encrypts everything written to it with the current key. Close
+// must be called to write the final chunk; it does not close w.
+func (k *Keyring) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	h := &header{
+		raw:    make([]byte, headerSize),
+		keyID:  k.current.ID,
+		prefix: make([]byte, prefixSize),
+	}
+	if _, err := rand.Read(h.prefix); err != nil {
+		return nil, err
+	}
+	copy(h.raw, magic)
+	binary.BigEndian.PutUint32(h.raw[len(magic):], h.keyID)
+	copy(h.raw[len(magic)+4:], h.prefix)
+	if _, err := w.Write(h.raw); err != nil {
+		return nil, err
+	}
+	return &writer{w: w, key: k.current, h: h, buf: make([]byte, 0, ChunkSize)}, nil
+}
+
+func (w *writer) seal(final bool) error {
+	out := w.key.aead.Seal(nil, nonce(w.h.prefix, w.index, final), w.buf, w.h.raw)
+	w.index++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(out)
+	return err
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	var n int
+	for len(p) > 0 {
+		if len(w.buf) == ChunkSize {
+			if err := w.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):ChunkSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+func (w *writer) Close() error {
+	return w.seal(true)
+}
+
+// Reader decrypts an encrypted file, and supports seeking within the
+// plaintext.
+type Reader struct {
+	rs     io.ReadSeeker
+	key    *Key
+	h      *header
+	size   int64
+	chunks int64
+
+	pos   int64
+	index int64
+	plain []byte
+}
+
+// NewReader decrypts rs if it is encrypted. Otherwise rs is returned as is.
+func (k *Keyring) NewReader(rs io.ReadSeeker) (io.ReadSeeker, error) {
+	h, err := readHeader(rs)
+	if err != nil || h == nil {
+		return rs, err
+	}
+	if k == nil {
+		return nil, ErrUnknownKey
+	}
+	key := k.keys[h.keyID]
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	size, err := rs.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	body := size - int64(headerSize)
+	chunks := (body + sealedChunk - 1) / sealedChunk
+	last := body - (chunks-1)*sealedChunk
+	if chunks == 0 || last < overhead {
+		return nil, ErrCorrupt
+	}
+	return &Reader{
+		rs:     rs,
+		key:    key,
+		h:      h,
+		size:   (chunks-1)*ChunkSize + last - overhead,
+		chunks: chunks,
+		index:  -1,
+	}, nil
+}
+
+// Size returns the length of the plaintext.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) load(index int64) error {
+	if index == r.index {
+		return nil
+	}
+	if _, err := r.rs.Seek(int64(headerSize)+index*sealedChunk, io.SeekStart); err != nil {
+		return err
+	}
+	sealed := make([]byte, sealedChunk)
+	n, err := io.ReadFull(r.rs, sealed)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	final := index == r.chunks-1
+	plain, err := r.key.aead.Open(r.plain[:0], nonce(r.h.prefix, uint32(index), final), sealed[:n], r.h.raw)
+	if err != nil {
+		r.index = -1
+		return ErrCorrupt
+	}
+	r.plain = plain
+	r.index = index
+	return nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if err := r.load(r.pos / ChunkSize); err != nil {
+		return 0, err
+	}
+	n := copy(p, r.plain[r.pos%ChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// EncryptFile encrypts the file at p in place with the current key. Files
+// already encrypted with another key in the keyring are re-encrypted, and
+// files already using the current key are left alone. It returns whether the
+// file was changed.
+func (k *Keyring) EncryptFile(p string) (bool, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	h, err := readHeader(f)
+	if err != nil {
+		return false, err
+	}
+	if h != nil && h.keyID == k.current.ID {
+		return false, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	src, err := k.NewReader(f)
+	if err != nil {
+		return false, err
+	}
+	return true, k.writeFile(p, src, fi.Mode())
+}
+
+// DecryptFile writes the plaintext of src to dst.
+func (k *Keyring) DecryptFile(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	plain, err := k.NewReader(f)
+	if err != nil {
+		return err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, plain); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// writeFile encrypts src into a temporary file, which replaces p on success.
+func (k *Keyring) writeFile(p string, src io.Reader, mode os.FileMode) error {
+	tmp := p + tempSuffix
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	err = func() error {
+		w, err := k.NewWriter(out)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, src); err != nil {
+			return err
+		}
+		if err := w.Close(); err != nil {
+			return err
+		}
+		return out.Sync()
+	}()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, p)
+}
@@ -0,0 +1,257 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newKey(t *testing.T) *Key {
+	t.Helper()
+	raw := make([]byte, KeySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatal(err)
+	}
+	k, err := ParseKey(base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func plaintext(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func seal(t *testing.T, k *Keyring, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := k.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// open decrypts sealed in full.
+func open(k *Keyring, sealed []byte) ([]byte, error) {
+	r, err := k.NewReader(bytes.NewReader(sealed))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	k := NewKeyring(newKey(t))
+	for _, n := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 5} {
+		plain := plaintext(t, n)
+		sealed := seal(t, k, plain)
+		if !bytes.HasPrefix(sealed, []byte(magic)) {
+			t.Errorf("%d bytes: missing header", n)
+		}
+		r, err := k.NewReader(bytes.NewReader(sealed))
+		if err != nil {
+			t.Fatalf("%d bytes: NewReader: %v", n, err)
+		}
+		if got := r.(*Reader).Size(); got != int64(n) {
+			t.Errorf("%d bytes: Size() = %d", n, got)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%d bytes: read: %v", n, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: plaintext differs after round trip", n)
+		}
+	}
+}
+
+func TestSeek(t *testing.T) {
+	k := NewKeyring(newKey(t))
+	plain := plaintext(t, 3*ChunkSize+100)
+	r, err := k.NewReader(bytes.NewReader(seal(t, k, plain)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{ChunkSize - 10, io.SeekStart, ChunkSize - 10},
+		{2*ChunkSize + 3, io.SeekStart, 2*ChunkSize + 3},
+		{-50, io.SeekEnd, int64(len(plain)) - 50},
+		{-ChunkSize, io.SeekCurrent, int64(len(plain)) - 50 - ChunkSize},
+		{0, io.SeekStart, 0},
+	} {
+		pos, err := r.Seek(tc.offset, tc.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d): %v", tc.offset, tc.whence, err)
+		}
+		if pos != tc.want {
+			t.Fatalf("Seek(%d, %d) = %d, want %d", tc.offset, tc.whence, pos, tc.want)
+		}
+		// Reads may span chunk boundaries.
+		got := make([]byte, 40)
+		n, err := io.ReadFull(r, got)
+		if end := int64(len(plain)) - pos; end < int64(len(got)) {
+			got = got[:end]
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("read at %d: got %v, want io.ErrUnexpectedEOF", pos, err)
+			}
+		} else if err != nil {
+			t.Fatalf("read at %d: %v", pos, err)
+		}
+		if !bytes.Equal(got[:n], plain[pos:pos+int64(n)]) {
+			t.Errorf("read at %d: plaintext differs", pos)
+		}
+		// Restore the position for SeekCurrent.
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Error("Seek to a negative position succeeded")
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	k := NewKeyring(newKey(t))
+	plain := plaintext(t, 3*ChunkSize)
+	sealed := seal(t, k, plain)
+	body := headerSize
+
+	swapped := append([]byte(nil), sealed...)
+	copy(swapped[body:], sealed[body+sealedChunk:body+2*sealedChunk])
+	copy(swapped[body+sealedChunk:], sealed[body:body+sealedChunk])
+
+	flipped := append([]byte(nil), sealed...)
+	flipped[body+ChunkSize/2] ^= 1
+
+	header := append([]byte(nil), sealed...)
+	header[len(magic)+4] ^= 1 // Nonce prefix, covered as additional data.
+
+	for _, tc := range []struct {
+		name   string
+		sealed []byte
+	}{
+		{"truncated at chunk boundary", sealed[:body+2*sealedChunk]},
+		{"truncated mid chunk", sealed[:len(sealed)-100]},
+		{"truncated to header", sealed[:body]},
+		{"chunks reordered", swapped},
+		{"byte flipped", flipped},
+		{"header modified", header},
+	} {
+		if _, err := open(k, tc.sealed); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("%s: got %v, want ErrCorrupt", tc.name, err)
+		}
+	}
+}
+
+func TestKeys(t *testing.T) {
+	k := NewKeyring(newKey(t))
+	plain := plaintext(t, 100)
+	sealed := seal(t, k, plain)
+
+	if _, err := open(NewKeyring(newKey(t)), sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("other key: got %v, want ErrUnknownKey", err)
+	}
+	if _, err := open(nil, sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("nil keyring: got %v, want ErrUnknownKey", err)
+	}
+
+	// Files which are not encrypted read as is, even without a keyring.
+	for _, keys := range []*Keyring{k, nil} {
+		got, err := open(keys, plain)
+		if err != nil {
+			t.Fatalf("plaintext: %v", err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Error("plaintext was modified")
+		}
+	}
+
+	for _, s := range []string{"", "not base64!", base64.StdEncoding.EncodeToString(make([]byte, 16))} {
+		if _, err := ParseKey(s); err == nil {
+			t.Errorf("ParseKey(%q) succeeded", s)
+		}
+	}
+}
+
+func keyID(t *testing.T, p string) uint32 {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(b, []byte(magic)) {
+		t.Fatalf("%v is not encrypted", p)
+	}
+	return binary.BigEndian.Uint32(b[len(magic):])
+}
+
+func TestRotation(t *testing.T) {
+	dir := t.TempDir()
+	p := filepath.Join(dir, "video.mp4")
+	plain := plaintext(t, 2*ChunkSize+7)
+	if err := os.WriteFile(p, plain, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey, currentKey := newKey(t), newKey(t)
+	old := NewKeyring(oldKey)
+	if changed, err := old.EncryptFile(p); err != nil || !changed {
+		t.Fatalf("encrypting plaintext: changed %v, err %v", changed, err)
+	}
+	if changed, err := old.EncryptFile(p); err != nil || changed {
+		t.Fatalf("encrypting again: changed %v, err %v", changed, err)
+	}
+	if id := keyID(t, p); id != oldKey.ID {
+		t.Fatalf("encrypted with key %x, want %x", id, oldKey.ID)
+	}
+
+	rotated := NewKeyring(currentKey, oldKey)
+	if changed, err := rotated.EncryptFile(p); err != nil || !changed {
+		t.Fatalf("rotating: changed %v, err %v", changed, err)
+	}
+	if id := keyID(t, p); id != currentKey.ID {
+		t.Fatalf("rotated to key %x, want %x", id, currentKey.ID)
+	}
+	if _, err := os.Stat(p + tempSuffix); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	dst := filepath.Join(dir, "plain.mp4")
+	if err := NewKeyring(currentKey).DecryptFile(p, dst); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Error("plaintext differs after rotation")
+	}
+
+	if err := old.DecryptFile(p, dst); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("decrypting with the old key only: got %v, want ErrUnknownKey", err)
+	}
+}
@@ -0,0 +1,125 @@
+package video
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// alertInterval limits how often the same condition is alerted.
+	alertInterval = time.Hour
+)
+
+var (
+	diskFreeBytes = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "cam_disk_free_bytes",
+		Help: "Free space on the filesystem holding recordings.",
+	})
+
+	recordingsRefused = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cam_recordings_refused_total",
+		Help: "Number of recordings not started because the disk was critically full.",
+	})
+)
+
+// AlertListener is notified of conditions requiring attention.
+type AlertListener interface {
+	Alert(message string)
+}
+
+func (f *Filesystem) AddAlertListener(l AlertListener) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.alerts = append(f.alerts, l)
+}
+
+// alert notifies listeners of a condition, identified by key, at most once per
+// alertInterval.
+func (f *Filesystem) alert(key, message string) {
+	log.Error(message)
+	f.l.Lock()
+	defer f.l.Unlock()
+	if time.Since(f.lastAlert[key]) < alertInterval {
+		return
+	}
+	f.lastAlert[key] = time.Now()
+	for _, l := range f.alerts {
+		go l.Alert(message)
+	}
+}
+
+// diskSpace returns the free and total bytes of the BasePath filesystem.
+func (f *Filesystem) diskSpace() (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(f.options.BasePath, &st); err != nil {
+		return 0, 0, err
+	}
+	free = st.Bavail * uint64(st.Bsize)
+	total = st.Blocks * uint64(st.Bsize)
+	diskFreeBytes.Set(float64(free))
+	return free, total, nil
+}
+
+// freePercent returns the percentage of free space, or 100 if unknown.
+func (f *Filesystem) freePercent() float64 {
+	free, total, err := f.diskSpace()
+	if err != nil {
+		log.Errorf("Failed to check free space on %v: %v", f.options.BasePath, err)
+		return 100
+	}
+	if total == 0 {
+		return 100
+	}
+	return float64(free) / float64(total) * 100
+}
+
+// freeDeficit returns how many bytes must be removed to reach MinFreePercent.
+func (f *Filesystem) freeDeficit() int64 {
+	if f.options.MinFreePercent == 0 {
+		return 0 // Disabled
+	}
+	free, total, err := f.diskSpace()
+	if err != nil {
+		log.Errorf("Failed to check free space on %v: %v", f.options.BasePath, err)
+		return 0
+	}
+	target := uint64(float64(total) * f.options.MinFreePercent / 100)
+	if free >= target {
+		return 0
+	}
+	return int64(target - free)
+}
+
+func (f *Filesystem) lowOnSpace() bool {
+	return f.options.MinFreePercent > 0 && f.freePercent() < f.options.MinFreePercent
+}
+
+// DiskCritical returns whether the disk is too full to start recording. An
+// alert is raised and garbage collection is requested if so.
+func (f *Filesystem) DiskCritical() bool {
+	if f.options.CriticalFreePercent == 0 {
+		return false // Disabled
+	}
+	pct := f.freePercent()
+	if pct >= f.options.CriticalFreePercent {
+		return false
+	}
+	recordingsRefused.Inc()
+	f.alert("disk-critical", fmt.Sprintf("Disk critically full (%.1f%% free on %v), recording refused", pct, f.options.BasePath))
+	f.requestGarbageCollect()
+	return true
+}
+
+// requestGarbageCollect runs garbage collection as soon as possible.
+func (f *Filesystem) requestGarbageCollect() {
+	select {
+	case f.gcNow <- true:
+	default:
+		// Already requested.
+	}
+}
@@ -0,0 +1,153 @@
+package video
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"cam/video/crypt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Encrypts returns whether event files are encrypted at rest.
+func (f *Filesystem) Encrypts() bool {
+	return f.options.Keyring != nil
+}
+
+// seal encrypts a finished file in place, if encryption is enabled. Files
+// already encrypted with an older key are re-encrypted.
+func (f *Filesystem) seal(p string) error {
+	if f.options.Keyring == nil {
+		return nil
+	}
+	_, err := f.options.Keyring.EncryptFile(p)
+	return err
+}
+
+type decryptingReader struct {
+	io.ReadSeeker
+	io.Closer
+}
+
+// decrypt wraps an event file so that it reads as plaintext. Files which are
+// not encrypted are returned as is.
+func (f *Filesystem) decrypt(rsc io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	rs, err := f.options.Keyring.NewReader(rsc)
+	if err != nil {
+		rsc.Close()
+		return nil, err
+	}
+	if rs == io.ReadSeeker(rsc) {
+		return rsc, nil
+	}
+	return &decryptingReader{ReadSeeker: rs, Closer: rsc}, nil
+}
+
+// Decrypt wraps one of the record's files so that it reads as plaintext. The
+// file is closed on failure.
+func (r *VideoRecord) Decrypt(rsc io.ReadSeekCloser) (io.ReadSeekCloser, error) {
+	return r.fs.decrypt(rsc)
+}
+
+// OpenFile opens a local event file, decrypting it if needed.
+func (f *Filesystem) OpenFile(p string) (io.ReadSeekCloser, error) {
+	lf, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	return f.decrypt(lf)
+}
+
+// plainPath provides the path of a file's plaintext, for tools such as ffmpeg
+// which read files directly. Encrypted files are decrypted to a temporary file
+// outside BasePath; done removes it.
+func (f *Filesystem) plainPath(p string) (plain string, done func(), err error) {
+	encrypted, err := crypt.IsEncrypted(p)
+	if err != nil || !encrypted {
+		return p, func() {}, err
+	}
+	tmp, err := os.CreateTemp("", "cam-*"+filepath.Ext(p))
+	if err != nil {
+		return "", nil, err
+	}
+	tmp.Close()
+	if err := f.options.Keyring.DecryptFile(p, tmp.Name()); err != nil {
+		os.Remove(tmp.Name())
+		return "", nil, err
+	}
+	return tmp.Name(), func() { os.Remove(tmp.Name()) }, nil
+}
+
+// hashFile returns the hex encoded SHA-256 of a file's plaintext.
+func (f *Filesystem) hashFile(p string) (string, error) {
+	rs, err := f.OpenFile(p)
+	if err != nil {
+		return "", err
+	}
+	defer rs.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, rs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// sealFiles encrypts the record's local files with the current key. It
+// returns whether any file changed.
+func (r *VideoRecord) sealFiles() (bool, error) {
+	paths := r.Paths()
+	var changed bool
+	for _, p := range []string{paths.VideoPath, paths.ThumbPath, paths.VThumbPath, paths.SpritePath, paths.VTTPath} {
+		c, err := r.fs.options.Keyring.EncryptFile(p)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return changed, err
+		}
+		changed = changed || c
+	}
+	return changed, nil
+}
+
+// encrypt brings the record's files up to date with the current key. Files
+// are sized again since encryption adds a small overhead, and the remote copy
+// is replaced.
+func (q *JobQueue) encrypt(r *VideoRecord) error {
+	if !q.fs.Encrypts() {
+		return errors.New("encryption is not enabled")
+	}
+	changed, err := r.sealFiles()
+	if err != nil || !changed {
+		return err
+	}
+	if err := r.UpdateSize(); err != nil {
+		return err
+	}
+	if r.Offloaded && !r.LocalEvicted {
+		q.Enqueue(r.Identifier, JobOffload)
+	}
+	log.Infof("Encrypted files of %v with the current key", r.Identifier)
+	return nil
+}
+
+// EnqueueEncrypt adds jobs to encrypt the files of every event with the
+// current key, whether they are not yet encrypted or use an older key. Only
+// local copies are handled, and events in the trash are skipped, so previous
+// keys should be kept until the trash has expired.
+func (q *JobQueue) EnqueueEncrypt() int {
+	var n int
+	for _, r := range q.fs.GetRecords(&RecordsFilter{}) {
+		if r.Recording() {
+			continue
+		}
+		if q.Enqueue(r.Identifier, JobEncrypt) {
+			n++
+		}
+	}
+	return n
+}
@@ -1,11 +1,14 @@
 package video
 
 import (
+	"cam/video/crypt"
 	"cam/video/process"
+	"cam/video/storage"
 	"database/sql/driver"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sync"
@@ -26,6 +29,10 @@ const (
 	ExtThumb = "_thumb.jpg"
 	// ExtVThumb is the extension for video thumbnail files.
 	ExtVThumb = "_vthumb.mp4"
+	// ExtSprite is the extension for scrubbing preview sprite sheets.
+	ExtSprite = "_sprite.jpg"
+	// ExtVTT is the extension for the WebVTT track describing the sprite sheet.
+	ExtVTT = "_sprite.vtt"
 
 	// FileTimeLayout defines the format of filenames.
 	// See https://golang.org/src/time/format.go.
@@ -78,16 +85,56 @@ type VideoRecord struct {
 	HaveVideo  bool
 	HaveThumb  bool
 	HaveVThumb bool
+	HaveSprite bool
+	HaveVTT    bool
 
 	// Length of the video file.
 	VideoDurationSec int
 
+	// VideoStartedAt is the time of the first frame of the video, if it does
+	// not include the usual pre-roll before TriggeredAt, as for saved clips.
+	VideoStartedAt *time.Time
+
 	// Combined size of this record on disk.
 	Size int64
 
+	// VideoSHA256 is the hex encoded hash of the video file, recorded when
+	// the video is finalized. Integrity verification compares against it,
+	// flagging the record if the file was modified or is unreadable.
+	VideoSHA256        string `gorm:"type:varchar(64)"`
+	IntegrityCheckedAt *time.Time
+	IntegrityFailed    bool
+	IntegrityError     string
+
+	// Offloaded is set once all files have been uploaded to remote storage,
+	// whose combined size is RemoteSize. LocalEvicted is set once local
+	// copies (except the thumbnail) have been removed.
+	Offloaded    bool
+	RemoteSize   int64
+	LocalEvicted bool
+
+	// Pinned records are exempt from garbage collection and retention tiers.
+	Pinned bool
+
+	// Favorite is set when a user stars the event.
+	Favorite bool
+
+	// Tags and Notes are stored in their own tables and filled in when the
+	// record is looked up.
+	Tags  []string    `gorm:"-"`
+	Notes []EventNote `gorm:"-"`
+
+	// RetentionTier is the number of the last retention tier applied, or 0 if
+	// the record is as recorded.
+	RetentionTier int
+
 	HaveClassification bool
 	Classification     *Classification
 
+	// Set if recording failed, fully or partially.
+	HaveError    bool
+	ErrorMessage string
+
 	// Reference to parent.
 	fs *Filesystem
 	l  sync.Mutex
@@ -98,6 +145,8 @@ type VideoRecordPaths struct {
 	VideoPath  string
 	ThumbPath  string
 	VThumbPath string
+	SpritePath string
+	VTTPath    string
 }
 
 // Paths provides locations for where new files should be created.
@@ -106,20 +155,38 @@ func (r *VideoRecord) Paths() *VideoRecordPaths {
 		VideoPath:  filepath.Join(r.fs.options.BasePath, r.Identifier+ExtVideo),
 		ThumbPath:  filepath.Join(r.fs.options.BasePath, r.Identifier+ExtThumb),
 		VThumbPath: filepath.Join(r.fs.options.BasePath, r.Identifier+ExtVThumb),
+		SpritePath: filepath.Join(r.fs.options.BasePath, r.Identifier+ExtSprite),
+		VTTPath:    filepath.Join(r.fs.options.BasePath, r.Identifier+ExtVTT),
 	}
 }
 
+// SpriteURL is how the WebVTT track refers to the sprite sheet. It is relative
+// to the track, and matches the "/vtt" and "/sprite" endpoints.
+func (r *VideoRecord) SpriteURL() string {
+	return "sprite?id=" + url.QueryEscape(r.Identifier)
+}
+
+// Recording returns whether video is still being written for this record.
+func (r *VideoRecord) Recording() bool {
+	return r.fs.isRecording(r.Identifier)
+}
+
 func (r *VideoRecord) SetDetections(detections []process.Detection) {
 	defer r.fs.notifyListeners()
 	r.l.Lock()
 	defer r.l.Unlock()
-	r.setDetections(detections)
-	if err := r.fs.db.Debug().Save(r).Error; err != nil {
-		log.Fatalf("SetDetections.Save %v for %v", err, spew.Sdump(r))
+	values := map[string]interface{}{}
+	r.setDetections(detections, values)
+	if len(values) == 0 {
+		return
+	}
+	if err := r.update(values); err != nil {
+		log.Errorf("SetDetections %v for %v", err, r.Identifier)
 	}
 }
 
-func (r *VideoRecord) setDetections(detections []process.Detection) {
+// setDetections records the detections, adding the changed columns to values.
+func (r *VideoRecord) setDetections(detections []process.Detection, values map[string]interface{}) {
 	if len(detections) == 0 {
 		return
 	}
@@ -127,19 +194,44 @@ func (r *VideoRecord) setDetections(detections []process.Detection) {
 	r.Classification = &Classification{
 		Detections: detections,
 	}
+	values["have_classification"] = true
+	values["classification"] = r.Classification
+}
+
+// SetError marks the record as having encountered a failure while recording.
+func (r *VideoRecord) SetError(err error) {
+	defer r.fs.notifyListeners()
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.HaveError = true
+	r.ErrorMessage = err.Error()
+	if err := r.update(map[string]interface{}{
+		"have_error":    true,
+		"error_message": r.ErrorMessage,
+	}); err != nil {
+		log.Errorf("SetError %v for %v", err, r.Identifier)
+	}
 }
 
 func (r *VideoRecord) UpdateVideo(detections []process.Detection) {
 	defer r.fs.notifyListeners()
+	defer r.fs.setRecording(r.Identifier, false)
 	p := r.Paths().VideoPath
-	fi, err := os.Stat(p)
+	ds, err := mp4util.Duration(p)
 	if err != nil {
-		log.Errorf("Failed to stat %v: %v", p, err)
+		log.Errorf("Failed to get video duration %v: %v", p, err)
 		return
 	}
-	ds, err := mp4util.Duration(p)
+	sum, err := r.fs.hashFile(p)
 	if err != nil {
-		log.Errorf("Failed to get video duration %v: %v", p, err)
+		log.Errorf("Failed to hash video %v: %v", p, err)
+	}
+	if err := r.fs.seal(p); err != nil {
+		log.Errorf("Failed to encrypt %v: %v", p, err)
+	}
+	fi, err := os.Stat(p)
+	if err != nil {
+		log.Errorf("Failed to stat %v: %v", p, err)
 		return
 	}
 	r.l.Lock()
@@ -147,9 +239,21 @@ func (r *VideoRecord) UpdateVideo(detections []process.Detection) {
 	r.HaveVideo = true
 	r.Size += fi.Size()
 	r.VideoDurationSec = ds
-	r.setDetections(detections)
-	if err = r.fs.db.Debug().Save(r).Error; err != nil {
-		log.Fatalf("UpdateVideo.Save %v for %v", err, spew.Sdump(r))
+	values := map[string]interface{}{
+		"have_video":         true,
+		"size":               gorm.Expr("size + ?", fi.Size()),
+		"video_duration_sec": ds,
+	}
+	if sum != "" {
+		now := time.Now()
+		r.VideoSHA256 = sum
+		r.IntegrityCheckedAt = &now
+		values["video_sha256"] = sum
+		values["integrity_checked_at"] = now
+	}
+	r.setDetections(detections, values)
+	if err = r.update(values); err != nil {
+		log.Errorf("UpdateVideo %v for %v", err, r.Identifier)
 	}
 }
 
@@ -157,6 +261,9 @@ func (r *VideoRecord) UpdateThumb() {
 	defer r.fs.notifyListeners()
 
 	p := r.Paths().ThumbPath
+	if err := r.fs.seal(p); err != nil {
+		log.Errorf("Failed to encrypt %v: %v", p, err)
+	}
 	fi, err := os.Stat(p)
 	if err != nil {
 		log.Errorf("Failed to stat %v: %v", p, err)
@@ -166,27 +273,115 @@ func (r *VideoRecord) UpdateThumb() {
 	defer r.l.Unlock()
 	r.HaveThumb = true
 	r.Size += fi.Size()
-	if err = r.fs.db.Debug().Save(r).Error; err != nil {
-		log.Fatalf("UpdateThumb.Save %v for %v", err, spew.Sdump(r))
+	if err = r.update(map[string]interface{}{
+		"have_thumb": true,
+		"size":       gorm.Expr("size + ?", fi.Size()),
+	}); err != nil {
+		log.Errorf("UpdateThumb %v for %v", err, r.Identifier)
 	}
 }
 
-func (r *VideoRecord) UpdateVThumb() {
+func (r *VideoRecord) UpdateVThumb() error {
 	defer r.fs.notifyListeners()
 
 	p := r.Paths().VThumbPath
+	if err := r.fs.seal(p); err != nil {
+		log.Errorf("Failed to encrypt %v: %v", p, err)
+	}
 	fi, err := os.Stat(p)
 	if err != nil {
-		log.Errorf("Failed to stat %v: %v", p, err)
-		return
+		return err
 	}
 	r.l.Lock()
 	defer r.l.Unlock()
 	r.HaveVThumb = true
 	r.Size += fi.Size()
-	if err = r.fs.db.Debug().Save(r).Error; err != nil {
-		log.Fatalf("UpdateVThumb.Save %v for %v", err, spew.Sdump(r))
+	return r.update(map[string]interface{}{
+		"have_v_thumb": true,
+		"size":         gorm.Expr("size + ?", fi.Size()),
+	})
+}
+
+// UpdateSprites records the sprite sheet and its WebVTT track, if created.
+func (r *VideoRecord) UpdateSprites() error {
+	defer r.fs.notifyListeners()
+
+	paths := r.Paths()
+	for _, p := range []string{paths.SpritePath, paths.VTTPath} {
+		if err := r.fs.seal(p); err != nil {
+			log.Errorf("Failed to encrypt %v: %v", p, err)
+		}
 	}
+	sfi, err := os.Stat(paths.SpritePath)
+	if err != nil {
+		return err
+	}
+	vfi, err := os.Stat(paths.VTTPath)
+	if err != nil {
+		return err
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.HaveSprite = true
+	r.HaveVTT = true
+	r.Size += sfi.Size() + vfi.Size()
+	return r.update(map[string]interface{}{
+		"have_sprite": true,
+		"have_vtt":    true,
+		"size":        gorm.Expr("size + ?", sfi.Size()+vfi.Size()),
+	})
+}
+
+// update writes only the given columns, so that changes made to others since
+// the record was looked up are kept. Records which have since been trashed or
+// deleted are left alone.
+func (r *VideoRecord) update(values map[string]interface{}) error {
+	return r.fs.db.Debug().Model(r).Updates(values).Error
+}
+
+func (r *VideoRecord) SetPinned(pinned bool) {
+	defer r.fs.notifyListeners()
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.Pinned = pinned
+	if err := r.fs.db.Debug().Model(r).Update("pinned", pinned).Error; err != nil {
+		log.Errorf("SetPinned %v for %v", err, r.Identifier)
+	}
+}
+
+// UpdateSize recomputes the combined size of the record's files, for when
+// existing files are replaced. Replaced files are encrypted if enabled.
+func (r *VideoRecord) UpdateSize() error {
+	defer r.fs.notifyListeners()
+
+	paths := r.Paths()
+	r.l.Lock()
+	defer r.l.Unlock()
+	var size int64
+	for have, p := range map[*bool]string{
+		&r.HaveVideo:  paths.VideoPath,
+		&r.HaveThumb:  paths.ThumbPath,
+		&r.HaveVThumb: paths.VThumbPath,
+		&r.HaveSprite: paths.SpritePath,
+		&r.HaveVTT:    paths.VTTPath,
+	} {
+		if !*have {
+			continue
+		}
+		if err := r.fs.seal(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fi, err := os.Stat(p)
+		if os.IsNotExist(err) && r.LocalEvicted {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		size += fi.Size()
+	}
+	r.Size = size
+	return r.update(map[string]interface{}{"size": size})
 }
 
 func (r *VideoRecord) Delete() {
@@ -200,9 +395,18 @@ func (r *VideoRecord) Delete() {
 			return
 		}
 		if err := os.Remove(p); err != nil {
+			if os.IsNotExist(err) && r.LocalEvicted {
+				return // Only the remote copy remains.
+			}
 			log.Errorf("Garbage collection failed for %v: %v", p, err)
 		}
 	}
+	// Outstanding jobs for this record are obsolete.
+	if err := r.fs.db.Unscoped().Where("identifier = ?", r.Identifier).Delete(&Job{}).Error; err != nil {
+		log.Errorf("Failed to remove jobs for %v: %v", r.Identifier, err)
+	}
+	r.deleteRemote()
+	r.deleteAnnotations()
 	paths := r.Paths()
 	if r.HaveVideo {
 		remove(paths.VideoPath)
@@ -213,8 +417,13 @@ func (r *VideoRecord) Delete() {
 	if r.HaveVThumb {
 		remove(paths.VThumbPath)
 	}
-	// Hard delete from database.
-	// TODO soft delete is probably fine
+	if r.HaveSprite {
+		remove(paths.SpritePath)
+	}
+	if r.HaveVTT {
+		remove(paths.VTTPath)
+	}
+	// Hard delete from database. See Trash for soft deletion.
 	if err := r.fs.db.Unscoped().Delete(r).Error; err != nil {
 		log.Fatalf("Delete %v for %v", err, spew.Sdump(r))
 	}
@@ -237,6 +446,38 @@ type FilesystemOptions struct {
 	// MaxAge defines the age threshold for garbage collection of old events on
 	// disk. Default value disables GC on size.
 	MaxAge time.Duration
+
+	// ClassMaxAge overrides MaxAge for events by detected class. Events without
+	// detections use the "motion" entry. If an event has several classes, the
+	// longest age applies.
+	ClassMaxAge map[string]time.Duration
+
+	// Remote, if set, receives finished events. MaxSize then applies to local
+	// copies: offloaded events over budget only have their local copies
+	// removed.
+	Remote storage.Backend
+
+	// MinFreePercent is the target free space on the BasePath filesystem.
+	// Garbage collection removes the oldest events until it is met. Default
+	// value disables GC on free space.
+	MinFreePercent float64
+
+	// CriticalFreePercent is the free space below which new recordings are
+	// refused. Default value disables the check.
+	CriticalFreePercent float64
+
+	// RemoteMaxSize defines the total size threshold for garbage collection of
+	// offloaded events. Default value disables GC on remote size.
+	RemoteMaxSize int64
+
+	// TrashExpiry is how long trashed events are kept before garbage
+	// collection purges them. Default value is DefaultTrashExpiry.
+	TrashExpiry time.Duration
+
+	// Keyring, if set, encrypts event files once they are finished. Files
+	// being written, such as the partial video of a recording in progress,
+	// are not encrypted.
+	Keyring *crypt.Keyring
 }
 
 type Filesystem struct {
@@ -245,6 +486,28 @@ type Filesystem struct {
 	listeners        []FilesystemListener
 	listenersDisable bool
 	l                sync.Mutex
+
+	// recording holds identifiers of records which are still being written.
+	recording map[string]bool
+	// partials holds the sinks of recordings which have a playable partial
+	// video.
+	partials map[string]partialSource
+
+	// maintenance serializes garbage collection and reconciliation. Jobs hold
+	// it for reading while they register as running, after which maintenance
+	// leaves their records alone.
+	maintenance sync.RWMutex
+
+	// running holds the jobs in progress for each identifier, so that they
+	// can be cancelled when the record is trashed.
+	running map[string][]*runningJob
+
+	// gcNow requests garbage collection ahead of schedule.
+	gcNow chan bool
+
+	alerts []AlertListener
+	// lastAlert is when each condition was last alerted.
+	lastAlert map[string]time.Time
 }
 
 func (f *Filesystem) DB() *gorm.DB {
@@ -269,6 +532,9 @@ func (c *dbConnector) Connect() (*gorm.DB, error) {
 	}
 	db.AutoMigrate(&DummyModel{})
 	db.AutoMigrate(&VideoRecord{})
+	db.AutoMigrate(&Job{})
+	db.AutoMigrate(&EventTag{})
+	db.AutoMigrate(&EventNote{})
 	log.Infof("Connected to mysql database")
 	return db, nil
 }
@@ -285,8 +551,13 @@ func NewFilesystem(opts FilesystemOptions) (*Filesystem, error) {
 		return nil, err
 	}
 	f := &Filesystem{
-		db:      db,
-		options: opts,
+		db:        db,
+		options:   opts,
+		recording: make(map[string]bool),
+		partials:  make(map[string]partialSource),
+		running:   make(map[string][]*runningJob),
+		lastAlert: make(map[string]time.Time),
+		gcNow:     make(chan bool, 1),
 	}
 
 	go func() {
@@ -294,8 +565,9 @@ func NewFilesystem(opts FilesystemOptions) (*Filesystem, error) {
 		for {
 			select {
 			case <-gt.C:
-				f.doGarbageCollect()
+			case <-f.gcNow:
 			}
+			f.GarbageCollect(false)
 		}
 	}()
 	return f, nil
@@ -311,9 +583,66 @@ func (f *Filesystem) NewRecord(t time.Time) *VideoRecord {
 	if err := f.db.Debug().Create(vr).Error; err != nil {
 		log.Fatalf("Failed to create new record: %v", err)
 	}
+	f.setRecording(id, true)
+	if f.lowOnSpace() {
+		// Make room before this recording fills the disk.
+		f.requestGarbageCollect()
+	}
 	return vr
 }
 
+func (f *Filesystem) setRecording(id string, recording bool) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if recording {
+		f.recording[id] = true
+	} else {
+		delete(f.recording, id)
+		delete(f.partials, id)
+	}
+}
+
+// partialSource provides the video written so far by a recording.
+type partialSource interface {
+	PartialPath() string
+}
+
+// setPartial registers where the partial video of a recording can be found,
+// for sinks which produce one.
+func (f *Filesystem) setPartial(id string, s partialSource) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	if f.recording[id] {
+		f.partials[id] = s
+	}
+}
+
+// PartialVideoPath returns the file holding the video written so far while
+// recording, or "" if none is available.
+func (r *VideoRecord) PartialVideoPath() string {
+	r.fs.l.Lock()
+	s := r.fs.partials[r.Identifier]
+	r.fs.l.Unlock()
+	if s == nil {
+		return ""
+	}
+	return s.PartialPath()
+}
+
+func (f *Filesystem) isRecording(id string) bool {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.recording[id]
+}
+
+// busy returns whether the record's files are being written, by a recording
+// or a running job. Maintenance leaves busy records alone.
+func (f *Filesystem) busy(id string) bool {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.recording[id] || len(f.running[id]) > 0
+}
+
 func (f *Filesystem) notifyListenersInBatch() chan<- bool {
 	f.l.Lock()
 	f.listenersDisable = true
@@ -346,48 +675,45 @@ func (f *Filesystem) AddListener(l FilesystemListener) {
 	f.listeners = append(f.listeners, l)
 }
 
-func (f *Filesystem) doGarbageCollect() {
-	gcStart := time.Now()
-	var toDelete []*VideoRecord
-	var total int64
-	for _, r := range f.GetRecords(&RecordsFilter{}) {
-		total += r.Size
+type RecordsFilter struct {
+	HaveClassification bool
 
-		overSize := func() bool {
-			if f.options.MaxSize == 0 {
-				return false // Disabled
-			}
-			return total > f.options.MaxSize
-		}
+	// Favorite limits results to starred events.
+	Favorite bool
 
-		overAge := func() bool {
-			if f.options.MaxAge == time.Duration(0) {
-				return false // Disabled
-			}
-			return r.TriggeredAt.Before(gcStart.Add(-f.options.MaxAge))
-		}
+	// Tags limits results to events which have all of the given tags.
+	Tags []string
 
-		if overSize() || overAge() {
-			toDelete = append(toDelete, r)
-		}
-	}
-	if len(toDelete) == 0 {
-		return
-	}
+	// Identifiers limits results to the given events.
+	Identifiers []string
 
-	ne := f.notifyListenersInBatch()
-	defer func() {
-		ne <- true
-	}()
+	// After and Before limit results to events triggered in the given range.
+	// Zero values are unbounded.
+	After  time.Time
+	Before time.Time
 
-	for _, r := range toDelete {
-		r.Delete()
-	}
-	log.Infof("Garbage collection removed %d records in %v", len(toDelete), time.Since(gcStart))
+	// Classes limits results to events with a detection of any of the given
+	// classes. "motion" matches events without detections.
+	Classes []string
 }
 
-type RecordsFilter struct {
-	HaveClassification bool
+// matchesClasses returns whether the record has a detection of any of the
+// given classes.
+func (r *VideoRecord) matchesClasses(classes []string) bool {
+	for _, c := range classes {
+		if c == motionClass && (r.Classification == nil || len(r.Classification.Detections) == 0) {
+			return true
+		}
+		if r.Classification == nil {
+			continue
+		}
+		for _, d := range r.Classification.Detections {
+			if d.Class == c {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 // GetRecords provides the current filesystem. Output be sorted by most recent first.
@@ -397,13 +723,42 @@ func (f *Filesystem) GetRecords(filter *RecordsFilter) []*VideoRecord {
 	if filter.HaveClassification {
 		q = q.Where("have_classification = true")
 	}
+	if filter.Favorite {
+		q = q.Where("favorite = true")
+	}
+	if len(filter.Identifiers) > 0 {
+		q = q.Where("identifier IN ?", filter.Identifiers)
+	}
+	if !filter.After.IsZero() {
+		q = q.Where("triggered_at >= ?", filter.After)
+	}
+	if !filter.Before.IsZero() {
+		q = q.Where("triggered_at < ?", filter.Before)
+	}
+	for _, t := range filter.Tags {
+		name, err := NormalizeTag(t)
+		if err != nil {
+			return []*VideoRecord{}
+		}
+		q = q.Where("identifier IN (?)", f.db.Model(&EventTag{}).Select("identifier").Where("name = ?", name))
+	}
 	if err := q.Find(&records).Error; err != nil {
 		log.Fatalf("Record lookup failed: %v for filter %v", err, spew.Sdump(filter))
 		return []*VideoRecord{}
 	}
+	if len(filter.Classes) > 0 {
+		matched := records[:0]
+		for _, r := range records {
+			if r.matchesClasses(filter.Classes) {
+				matched = append(matched, r)
+			}
+		}
+		records = matched
+	}
 	for _, r := range records {
 		r.fs = f
 	}
+	f.loadAnnotations(records)
 	return records
 }
 
@@ -416,5 +771,6 @@ func (f *Filesystem) GetRecordByID(ID string) *VideoRecord {
 		log.Fatalf("GetRecordById %v over ID %v", err, ID)
 	}
 	record.fs = f
+	f.loadAnnotations([]*VideoRecord{record})
 	return record
 }
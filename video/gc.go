@@ -0,0 +1,213 @@
+package video
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Garbage collection actions.
+const (
+	GCDelete = "delete"
+	GCEvict  = "evict"
+)
+
+// GCAction is a change made to a record by garbage collection.
+type GCAction struct {
+	ID     string
+	Action string
+	Reason string
+	Size   int64
+
+	record *VideoRecord
+}
+
+// GCReport lists the changes made by garbage collection, or which would be
+// made for a dry run.
+type GCReport struct {
+	DryRun  bool
+	Actions []*GCAction
+	Elapsed time.Duration
+}
+
+// motionClass is the ClassMaxAge key for events without detections.
+const motionClass = "motion"
+
+// maxAge returns the age after which a record is deleted, or zero if there is
+// no limit.
+func (f *Filesystem) maxAge(r *VideoRecord) time.Duration {
+	var classes []string
+	if r.Classification != nil {
+		for _, d := range r.Classification.Detections {
+			classes = append(classes, d.Class)
+		}
+	}
+	if len(classes) == 0 {
+		classes = []string{motionClass}
+	}
+
+	var age time.Duration
+	matched := false
+	for _, c := range classes {
+		if a, ok := f.options.ClassMaxAge[c]; ok {
+			matched = true
+			if a > age {
+				age = a
+			}
+		}
+	}
+	if !matched {
+		return f.options.MaxAge
+	}
+	return age
+}
+
+// planGarbageCollect determines which records to delete or evict.
+func (f *Filesystem) planGarbageCollect(now time.Time) []*GCAction {
+	return f.planRecords(now, f.GetRecords(&RecordsFilter{}), f.GetTrash())
+}
+
+// planRecords plans garbage collection of records, newest first, and trash,
+// most recently trashed first. The trash is purged first. Records are then
+// considered newest first, so that size budgets keep the most recent events.
+func (f *Filesystem) planRecords(now time.Time, records, trash []*VideoRecord) []*GCAction {
+	var remoteTotal int64
+	var liveSize int64
+	for _, r := range records {
+		liveSize += r.Size
+	}
+	actions, trash, total := f.planTrash(now, trash, liveSize)
+	for _, r := range records {
+		total += r.Size
+		remoteTotal += r.RemoteSize
+		if r.Pinned || f.busy(r.Identifier) {
+			continue
+		}
+
+		overSize := func() bool {
+			if f.options.MaxSize == 0 {
+				return false // Disabled
+			}
+			return total > f.options.MaxSize
+		}
+
+		overRemoteSize := func() bool {
+			if f.options.RemoteMaxSize == 0 {
+				return false // Disabled
+			}
+			return remoteTotal > f.options.RemoteMaxSize
+		}
+
+		overAge := func() bool {
+			maxAge := f.maxAge(r)
+			if maxAge == time.Duration(0) {
+				return false // Disabled
+			}
+			return r.TriggeredAt.Before(now.Add(-maxAge))
+		}
+
+		a := &GCAction{
+			ID:     r.Identifier,
+			Action: GCDelete,
+			Size:   r.Size + r.RemoteSize,
+			record: r,
+		}
+		switch {
+		case overAge():
+			a.Reason = "age"
+		case overRemoteSize():
+			a.Reason = "remote size"
+		case overSize() && r.Offloaded:
+			if r.LocalEvicted {
+				continue
+			}
+			a.Action = GCEvict
+			a.Reason = "size"
+			a.Size = r.Size
+		case overSize():
+			a.Reason = "size"
+		default:
+			continue
+		}
+		actions = append(actions, a)
+	}
+	// Trashed records go last, so they are the first to free space.
+	return f.planFreeSpace(append(records, trash...), actions)
+}
+
+// planFreeSpace adds actions for the oldest remaining records until enough
+// will be removed from the local disk to reach MinFreePercent.
+func (f *Filesystem) planFreeSpace(records []*VideoRecord, actions []*GCAction) []*GCAction {
+	deficit := f.freeDeficit()
+	if deficit == 0 {
+		return actions
+	}
+	planned := make(map[string]bool)
+	for _, a := range actions {
+		planned[a.ID] = true
+		deficit -= a.record.Size
+	}
+	for i := len(records) - 1; i >= 0 && deficit > 0; i-- {
+		r := records[i]
+		if planned[r.Identifier] || r.Pinned || r.LocalEvicted || f.busy(r.Identifier) {
+			continue
+		}
+		a := &GCAction{
+			ID:     r.Identifier,
+			Action: GCDelete,
+			Reason: "free space",
+			Size:   r.Size + r.RemoteSize,
+			record: r,
+		}
+		if r.Offloaded {
+			a.Action = GCEvict
+			a.Size = r.Size
+		}
+		actions = append(actions, a)
+		deficit -= r.Size
+	}
+	if deficit > 0 {
+		log.Warnf("Garbage collection unable to free %d bytes to reach the free space target", deficit)
+	}
+	return actions
+}
+
+// GarbageCollect deletes records which are too old or exceed the size
+// budgets, and evicts local copies of offloaded records. If dryRun is set,
+// nothing is changed.
+func (f *Filesystem) GarbageCollect(dryRun bool) *GCReport {
+	f.maintenance.Lock()
+	defer f.maintenance.Unlock()
+
+	gcStart := time.Now()
+	report := &GCReport{
+		DryRun:  dryRun,
+		Actions: f.planGarbageCollect(gcStart),
+	}
+	if dryRun || len(report.Actions) == 0 {
+		report.Elapsed = time.Since(gcStart)
+		return report
+	}
+
+	ne := f.notifyListenersInBatch()
+	defer func() {
+		ne <- true
+	}()
+
+	var deleted, evicted int
+	for _, a := range report.Actions {
+		switch a.Action {
+		case GCEvict:
+			a.record.l.Lock()
+			a.record.evictLocal()
+			a.record.l.Unlock()
+			evicted++
+		case GCDelete:
+			a.record.Delete()
+			deleted++
+		}
+	}
+	report.Elapsed = time.Since(gcStart)
+	log.Infof("Garbage collection removed %d records and evicted %d local copies in %v", deleted, evicted, report.Elapsed)
+	return report
+}
@@ -0,0 +1,152 @@
+package video
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"cam/video/process"
+)
+
+var gcNow = time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+
+// testRecord creates a record triggered age before gcNow.
+func testRecord(id string, age time.Duration, size int64, classes ...string) *VideoRecord {
+	r := &VideoRecord{
+		Identifier:  id,
+		TriggeredAt: gcNow.Add(-age),
+		Size:        size,
+	}
+	if len(classes) > 0 {
+		r.Classification = &Classification{}
+		for _, c := range classes {
+			r.Classification.Detections = append(r.Classification.Detections, process.Detection{Class: c, Confidence: 0.9})
+		}
+	}
+	return r
+}
+
+func newTestFilesystem(opts FilesystemOptions) *Filesystem {
+	return &Filesystem{
+		options:   opts,
+		recording: make(map[string]bool),
+		partials:  make(map[string]partialSource),
+		running:   make(map[string][]*runningJob),
+		lastAlert: make(map[string]time.Time),
+	}
+}
+
+// summarize lists actions as "id action reason".
+func summarize(actions []*GCAction) []string {
+	var s []string
+	for _, a := range actions {
+		s = append(s, a.ID+" "+a.Action+" "+a.Reason)
+	}
+	return s
+}
+
+const day = 24 * time.Hour
+
+func TestPlanGarbageCollect(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		opts      FilesystemOptions
+		records   []*VideoRecord // Newest first.
+		recording string
+		job       string
+		want      []string
+	}{
+		{
+			name: "age",
+			opts: FilesystemOptions{MaxAge: 30 * day},
+			records: []*VideoRecord{
+				testRecord("a", 10*day, 100),
+				testRecord("b", 40*day, 100),
+				testRecord("c", 50*day, 100),
+			},
+			want: []string{"b delete age", "c delete age"},
+		},
+		{
+			name: "age by class",
+			opts: FilesystemOptions{
+				MaxAge:      30 * day,
+				ClassMaxAge: map[string]time.Duration{"motion": 3 * day, "person": 60 * day},
+			},
+			records: []*VideoRecord{
+				testRecord("motion", 5*day, 100),
+				testRecord("person", 40*day, 100, "person"),
+				// The longest retention of any detected class applies.
+				testRecord("both", 40*day, 100, "motion", "person"),
+				testRecord("car", 40*day, 100, "car"),
+			},
+			want: []string{"motion delete age", "car delete age"},
+		},
+		{
+			name: "size keeps newest",
+			opts: FilesystemOptions{MaxSize: 250},
+			records: []*VideoRecord{
+				testRecord("a", 1*day, 100),
+				testRecord("b", 2*day, 100),
+				testRecord("c", 3*day, 100),
+				testRecord("d", 4*day, 100),
+			},
+			want: []string{"c delete size", "d delete size"},
+		},
+		{
+			name: "pinned and recording are exempt",
+			opts: FilesystemOptions{MaxAge: day, MaxSize: 100},
+			records: []*VideoRecord{
+				testRecord("recording", 0, 100),
+				testRecord("a", 2*day, 100),
+				{Identifier: "pinned", TriggeredAt: gcNow.Add(-3 * day), Size: 100, Pinned: true},
+			},
+			recording: "recording",
+			want:      []string{"a delete age"},
+		},
+		{
+			name: "records with running jobs are exempt",
+			opts: FilesystemOptions{MaxAge: day},
+			records: []*VideoRecord{
+				testRecord("a", 2*day, 100),
+				testRecord("b", 3*day, 100),
+			},
+			job:  "b",
+			want: []string{"a delete age"},
+		},
+		{
+			name: "offloaded are evicted",
+			opts: FilesystemOptions{MaxSize: 100},
+			records: []*VideoRecord{
+				testRecord("a", 1*day, 100),
+				{Identifier: "b", TriggeredAt: gcNow.Add(-2 * day), Size: 100, Offloaded: true},
+				{Identifier: "c", TriggeredAt: gcNow.Add(-3 * day), Size: 10, Offloaded: true, LocalEvicted: true},
+				testRecord("d", 4*day, 100),
+			},
+			want: []string{"b evict size", "d delete size"},
+		},
+		{
+			name: "remote size",
+			opts: FilesystemOptions{RemoteMaxSize: 150},
+			records: []*VideoRecord{
+				{Identifier: "a", TriggeredAt: gcNow.Add(-1 * day), RemoteSize: 100, Offloaded: true},
+				{Identifier: "b", TriggeredAt: gcNow.Add(-2 * day), RemoteSize: 100, Offloaded: true},
+			},
+			want: []string{"b delete remote size"},
+		},
+	} {
+		f := newTestFilesystem(tc.opts)
+		if tc.recording != "" {
+			f.setRecording(tc.recording, true)
+		}
+		done := func() {}
+		if tc.job != "" {
+			_, done = f.startJob(context.Background(), tc.job)
+		}
+		got := summarize(f.planRecords(gcNow, tc.records, nil))
+		done()
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
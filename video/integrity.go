@@ -0,0 +1,133 @@
+package video
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"cam/video/crypt"
+
+	"github.com/pillash/mp4util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// IntegrityCheckInterval controls how often each video is verified
+	// against its recorded hash.
+	IntegrityCheckInterval = 7 * 24 * time.Hour
+)
+
+var integrityFailures = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "cam_integrity_failures_total",
+	Help: "Number of videos found modified or corrupt by integrity verification.",
+})
+
+// rehash records the hash of the video after it has been intentionally
+// replaced, e.g. by re-encoding.
+func (r *VideoRecord) rehash() error {
+	sum, err := r.fs.hashFile(r.Paths().VideoPath)
+	if err != nil {
+		return err
+	}
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.VideoSHA256 = sum
+	r.IntegrityFailed = false
+	r.IntegrityError = ""
+	return r.update(map[string]interface{}{
+		"video_sha256":     sum,
+		"integrity_failed": false,
+		"integrity_error":  "",
+	})
+}
+
+// verifyIntegrity compares the video with its recorded hash and checks that it
+// is readable, flagging the record if not. Records from before hashes were
+// kept have their current hash recorded instead.
+func (r *VideoRecord) verifyIntegrity() error {
+	p := r.Paths().VideoPath
+	sum, err := r.fs.hashFile(p)
+	if err != nil && !os.IsNotExist(err) && !errors.Is(err, crypt.ErrCorrupt) {
+		return err
+	}
+
+	var problem string
+	switch {
+	case os.IsNotExist(err):
+		problem = "video file is missing"
+	case err != nil:
+		problem = fmt.Sprintf("video corrupt: %v", err)
+	case r.VideoSHA256 != "" && sum != r.VideoSHA256:
+		problem = fmt.Sprintf("video modified: sha256 is %v, expected %v", sum, r.VideoSHA256)
+	default:
+		plain, done, err := r.fs.plainPath(p)
+		if err != nil {
+			return err
+		}
+		if _, err := mp4util.Duration(plain); err != nil {
+			problem = fmt.Sprintf("video corrupt: %v", err)
+		}
+		done()
+	}
+
+	defer r.fs.notifyListeners()
+	r.l.Lock()
+	defer r.l.Unlock()
+	now := time.Now()
+	r.IntegrityCheckedAt = &now
+	values := map[string]interface{}{"integrity_checked_at": now}
+	if r.VideoSHA256 == "" && problem == "" {
+		log.Infof("Recorded missing hash for %v", r.Identifier)
+		r.VideoSHA256 = sum
+		values["video_sha256"] = sum
+	}
+	if problem != "" {
+		r.markFailed(problem, values)
+	}
+	return r.update(values)
+}
+
+// markFailed flags the record as having failed an integrity check, adding the
+// changed columns to values. r.l must be held.
+func (r *VideoRecord) markFailed(problem string, values map[string]interface{}) {
+	integrityFailures.Inc()
+	r.IntegrityFailed = true
+	r.IntegrityError = problem
+	values["integrity_failed"] = true
+	values["integrity_error"] = problem
+	r.fs.alert("integrity-"+r.Identifier, fmt.Sprintf("Integrity check failed for event %v: %v", r.Identifier, problem))
+}
+
+// FlagIntegrity records that the video was found modified or corrupt outside
+// of verification, e.g. when exporting it.
+func (r *VideoRecord) FlagIntegrity(problem string) error {
+	defer r.fs.notifyListeners()
+	r.l.Lock()
+	defer r.l.Unlock()
+	values := map[string]interface{}{}
+	r.markFailed(problem, values)
+	return r.update(values)
+}
+
+// EnqueueVerify adds integrity verification jobs for videos which have not
+// been checked within IntegrityCheckInterval. Records already flagged are not
+// checked again.
+func (q *JobQueue) EnqueueVerify() int {
+	var n int
+	due := time.Now().Add(-IntegrityCheckInterval)
+	for _, r := range q.fs.GetRecords(&RecordsFilter{}) {
+		if !r.HaveVideo || r.LocalEvicted || r.IntegrityFailed || r.Recording() {
+			continue
+		}
+		if r.IntegrityCheckedAt != nil && r.IntegrityCheckedAt.After(due) {
+			continue
+		}
+		if q.Enqueue(r.Identifier, JobVerify) {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,503 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"cam/config"
+	"cam/video/process"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Post-processing job kinds.
+const (
+	JobVThumb   = "vthumb"
+	JobSprites  = "sprites"
+	JobReencode = "reencode"
+	JobOffload  = "offload"
+
+	// JobRetention applies the retention tier for the event's age.
+	JobRetention = "retention"
+
+	// JobVerify checks the video against its recorded hash.
+	JobVerify = "verify"
+
+	// JobEncrypt encrypts the event's files with the current key.
+	JobEncrypt = "encrypt"
+)
+
+// Job states. Completed jobs are removed.
+const (
+	JobPending = "pending"
+	JobRunning = "running"
+	JobFailed  = "failed"
+)
+
+const (
+	// jobPollInterval bounds how long a job waits for a worker when its retry
+	// time is reached, since workers are only woken for new jobs.
+	jobPollInterval = 15 * time.Second
+)
+
+// Job is a post-processing task for an event, persisted so that it survives
+// restarts.
+type Job struct {
+	gorm.Model
+
+	Kind       string `gorm:"type:varchar(32);index"`
+	Identifier string `gorm:"type:varchar(100);index"`
+	State      string `gorm:"type:varchar(16);index"`
+
+	Attempts      int
+	NextAttemptAt time.Time
+	LastError     string
+}
+
+type JobQueueOptions struct {
+	// Concurrency is the number of jobs run at once. Defaults to 1.
+	Concurrency int
+
+	// MaxAttempts is the number of times a job is tried before it is marked
+	// as failed. Defaults to 5.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry, doubling for each attempt
+	// up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	VThumbProducer *process.VThumbProducer
+
+	// ReencodeProfile is used by JobReencode.
+	ReencodeProfile config.EncodingProfile
+}
+
+// JobQueue runs post-processing jobs stored in the database.
+type JobQueue struct {
+	fs   *Filesystem
+	opts JobQueueOptions
+
+	wake   chan bool
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// claim serializes selecting the next job between workers, and checking
+	// for duplicates when adding jobs.
+	claim sync.Mutex
+}
+
+// errRecordGone indicates the event was deleted; the job is dropped.
+var errRecordGone = errors.New("record no longer exists")
+
+// errJobWaiting indicates the job can't run until others for the event have
+// finished. It is tried again after jobPollInterval, without counting as an
+// attempt.
+var errJobWaiting = errors.New("waiting for other jobs to finish")
+
+func NewJobQueue(fs *Filesystem, opts JobQueueOptions) *JobQueue {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 1
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = time.Minute
+	}
+	if opts.MaxBackoff == 0 {
+		opts.MaxBackoff = time.Hour
+	}
+	q := &JobQueue{
+		fs:   fs,
+		opts: opts,
+		wake: make(chan bool, opts.Concurrency),
+	}
+	q.ctx, q.cancel = context.WithCancel(context.Background())
+
+	// Jobs left running by a previous process were interrupted.
+	if err := fs.db.Model(&Job{}).Where("state = ?", JobRunning).Update("state", JobPending).Error; err != nil {
+		log.Errorf("Failed to reset interrupted jobs: %v", err)
+	}
+
+	for i := 0; i < opts.Concurrency; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+	go q.regenerate()
+	return q
+}
+
+// Enqueue adds a job for an event, unless one of the same kind is already
+// queued. A failed job of the same kind is reset to be attempted again.
+// Returns whether a job was added or reset.
+func (q *JobQueue) Enqueue(identifier, kind string) bool {
+	q.claim.Lock()
+	defer q.claim.Unlock()
+
+	existing := &Job{}
+	err := q.fs.db.Where("identifier = ? AND kind = ?", identifier, kind).First(existing).Error
+	if err == nil {
+		if existing.State != JobFailed {
+			return false
+		}
+		if err := q.reset(existing.ID); err != nil {
+			log.Errorf("Failed to reset %v job for %v: %v", kind, identifier, err)
+			return false
+		}
+		q.notify()
+		return true
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		log.Errorf("Failed to check for existing %v job for %v: %v", kind, identifier, err)
+		return false
+	}
+	j := &Job{
+		Kind:          kind,
+		Identifier:    identifier,
+		State:         JobPending,
+		NextAttemptAt: time.Now(),
+	}
+	if err := q.fs.db.Create(j).Error; err != nil {
+		log.Errorf("Failed to enqueue %v job for %v: %v", kind, identifier, err)
+		return false
+	}
+	q.notify()
+	return true
+}
+
+// Retry resets a failed job so it is attempted again.
+func (q *JobQueue) Retry(id uint) error {
+	if err := q.reset(id); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+func (q *JobQueue) reset(id uint) error {
+	res := q.fs.db.Model(&Job{}).Where("id = ? AND state = ?", id, JobFailed).Updates(map[string]interface{}{
+		"state":           JobPending,
+		"attempts":        0,
+		"next_attempt_at": time.Now(),
+	})
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("no failed job with id %d", id)
+	}
+	return nil
+}
+
+// Jobs lists all outstanding and failed jobs, oldest first.
+func (q *JobQueue) Jobs() ([]*Job, error) {
+	var jobs []*Job
+	err := q.fs.db.Order("created_at").Find(&jobs).Error
+	return jobs, err
+}
+
+// EnqueueMissing adds jobs for any finished event which lacks a video thumbnail
+// or sprite sheet, or has not been offloaded to remote storage.
+func (q *JobQueue) EnqueueMissing() int {
+	var n int
+	for _, r := range q.fs.GetRecords(&RecordsFilter{}) {
+		if !r.HaveVideo || r.LocalEvicted || r.Recording() {
+			continue
+		}
+		if q.fs.HasRemote() && !r.Offloaded && q.Enqueue(r.Identifier, JobOffload) {
+			n++
+		}
+		if !r.HaveVThumb && q.Enqueue(r.Identifier, JobVThumb) {
+			n++
+		}
+		if !r.HaveSprite && q.Enqueue(r.Identifier, JobSprites) {
+			n++
+		}
+	}
+	return n
+}
+
+// regenerate periodically checks for missing previews, events due for a
+// retention tier, and videos due for integrity verification. Startup is
+// covered by reconciliation.
+func (q *JobQueue) regenerate() {
+	t := time.NewTicker(GarbageCollectionInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-q.ctx.Done():
+			return
+		}
+		if n := q.EnqueueMissing(); n > 0 {
+			log.Infof("Scheduled %d jobs to regenerate missing previews", n)
+		}
+		if n := q.EnqueueRetention(); n > 0 {
+			log.Infof("Scheduled %d jobs to apply retention tiers", n)
+		}
+		if n := q.EnqueueVerify(); n > 0 {
+			log.Infof("Scheduled %d jobs to verify video integrity", n)
+		}
+	}
+}
+
+func (q *JobQueue) notify() {
+	for i := 0; i < q.opts.Concurrency; i++ {
+		select {
+		case q.wake <- true:
+		default:
+			return
+		}
+	}
+}
+
+// next claims the next job which is due, or returns nil.
+func (q *JobQueue) next() *Job {
+	q.claim.Lock()
+	defer q.claim.Unlock()
+
+	j := &Job{}
+	err := q.fs.db.Where("state = ? AND next_attempt_at <= ?", JobPending, time.Now()).Order("next_attempt_at").First(j).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	}
+	if err != nil {
+		log.Errorf("Failed to fetch next job: %v", err)
+		return nil
+	}
+	j.State = JobRunning
+	j.Attempts++
+	if err := q.fs.db.Save(j).Error; err != nil {
+		log.Errorf("Failed to claim job %d: %v", j.ID, err)
+		return nil
+	}
+	return j
+}
+
+func (q *JobQueue) worker() {
+	defer q.wg.Done()
+	t := time.NewTicker(jobPollInterval)
+	defer t.Stop()
+	for {
+		for j := q.next(); j != nil; j = q.next() {
+			q.finish(j, q.run(j))
+			if q.ctx.Err() != nil {
+				return
+			}
+		}
+		select {
+		case <-q.wake:
+		case <-t.C:
+		case <-q.ctx.Done():
+			return
+		}
+	}
+}
+
+// finish records the outcome of a job, scheduling a retry if it failed.
+func (q *JobQueue) finish(j *Job, err error) {
+	l := log.WithFields(log.Fields{"job": j.ID, "kind": j.Kind, "id": j.Identifier})
+	if err == nil || errors.Is(err, errRecordGone) {
+		l.Infof("Job completed after %d attempts", j.Attempts)
+		if err := q.fs.db.Unscoped().Delete(j).Error; err != nil {
+			l.Errorf("Failed to remove completed job: %v", err)
+		}
+		return
+	}
+
+	j.LastError = err.Error()
+	if errors.Is(err, errJobWaiting) {
+		j.State = JobPending
+		j.Attempts--
+		j.NextAttemptAt = time.Now().Add(jobPollInterval)
+	} else if q.ctx.Err() != nil {
+		// Interrupted by shutdown; try again next time without penalty.
+		j.State = JobPending
+		j.Attempts--
+	} else if j.Attempts >= q.opts.MaxAttempts {
+		l.Errorf("Job failed permanently: %v", err)
+		j.State = JobFailed
+	} else {
+		backoff := q.opts.Backoff << (j.Attempts - 1)
+		if backoff > q.opts.MaxBackoff || backoff <= 0 {
+			backoff = q.opts.MaxBackoff
+		}
+		l.Warnf("Job failed, retrying in %v: %v", backoff, err)
+		j.State = JobPending
+		j.NextAttemptAt = time.Now().Add(backoff)
+	}
+	if err := q.fs.db.Save(j).Error; err != nil {
+		l.Errorf("Failed to update job: %v", err)
+	}
+}
+
+// runningJob is a job in progress, which can be cancelled.
+type runningJob struct {
+	cancel context.CancelFunc
+	done   chan bool
+}
+
+// startJob registers a job in progress for an identifier, which garbage
+// collection and reconciliation then leave alone. The returned context is
+// cancelled if the record is trashed, and done must be called once the job
+// has finished.
+func (f *Filesystem) startJob(ctx context.Context, id string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	rj := &runningJob{cancel: cancel, done: make(chan bool)}
+	// Wait for any maintenance in progress, which doesn't expect the record
+	// to become busy.
+	f.maintenance.RLock()
+	f.l.Lock()
+	f.running[id] = append(f.running[id], rj)
+	f.l.Unlock()
+	f.maintenance.RUnlock()
+	return ctx, func() {
+		cancel()
+		f.l.Lock()
+		jobs := f.running[id]
+		for i, o := range jobs {
+			if o == rj {
+				jobs = append(jobs[:i], jobs[i+1:]...)
+				break
+			}
+		}
+		if len(jobs) == 0 {
+			delete(f.running, id)
+		} else {
+			f.running[id] = jobs
+		}
+		f.l.Unlock()
+		close(rj.done)
+	}
+}
+
+// cancelJobs cancels any jobs in progress for an identifier, and waits for
+// them to finish.
+func (f *Filesystem) cancelJobs(id string) {
+	f.l.Lock()
+	jobs := append([]*runningJob(nil), f.running[id]...)
+	f.l.Unlock()
+	for _, rj := range jobs {
+		rj.cancel()
+		<-rj.done
+	}
+}
+
+func (q *JobQueue) run(j *Job) error {
+	ctx, done := q.fs.startJob(q.ctx, j.Identifier)
+	defer done()
+	err := q.runJob(ctx, j)
+	if err != nil && ctx.Err() != nil && q.ctx.Err() == nil {
+		// Cancelled because the record was trashed.
+		return errRecordGone
+	}
+	return err
+}
+
+func (q *JobQueue) runJob(ctx context.Context, j *Job) error {
+	r := q.fs.GetRecordByID(j.Identifier)
+	if r == nil {
+		return errRecordGone
+	}
+	if r.Recording() {
+		return errors.New("record is still recording")
+	}
+	if j.Kind == JobEncrypt {
+		// Applies to whatever files are present, even without video.
+		return q.encrypt(r)
+	}
+	if !r.HaveVideo {
+		return errors.New("record has no video")
+	}
+	if r.LocalEvicted {
+		return errors.New("local copy has been evicted")
+	}
+	paths := r.Paths()
+	duration := time.Duration(r.VideoDurationSec) * time.Second
+
+	// ffmpeg needs to read the plaintext.
+	src := paths.VideoPath
+	switch j.Kind {
+	case JobVThumb, JobSprites, JobReencode, JobRetention:
+		plain, done, err := q.fs.plainPath(paths.VideoPath)
+		if err != nil {
+			return err
+		}
+		defer done()
+		src = plain
+	}
+
+	switch j.Kind {
+	case JobVThumb:
+		if err := q.opts.VThumbProducer.VThumb(ctx, src, paths.VThumbPath); err != nil {
+			return err
+		}
+		if r.HaveVThumb {
+			if err := r.UpdateSize(); err != nil {
+				return err
+			}
+		} else if err := r.UpdateVThumb(); err != nil {
+			return err
+		}
+	case JobSprites:
+		if err := q.opts.VThumbProducer.Sprites(ctx, src, paths.SpritePath, paths.VTTPath, r.SpriteURL(), duration); err != nil {
+			return err
+		}
+		if r.HaveSprite {
+			if err := r.UpdateSize(); err != nil {
+				return err
+			}
+		} else if err := r.UpdateSprites(); err != nil {
+			return err
+		}
+	case JobReencode:
+		if err := process.Reencode(ctx, src, paths.VideoPath, q.opts.ReencodeProfile); err != nil {
+			return err
+		}
+		if err := r.rehash(); err != nil {
+			return err
+		}
+		if err := r.UpdateSize(); err != nil {
+			return err
+		}
+	case JobRetention:
+		if err := q.applyRetention(ctx, r, src); err != nil {
+			return err
+		}
+	case JobVerify:
+		// Nothing is changed, so the remote copy stays current.
+		return r.verifyIntegrity()
+	case JobOffload:
+		// Upload once all other processing has finished, so that everything is
+		// included.
+		var others int64
+		if err := q.fs.db.Model(&Job{}).Where("identifier = ? AND kind <> ? AND state <> ?", j.Identifier, JobOffload, JobFailed).Count(&others).Error; err != nil {
+			return err
+		}
+		if others > 0 {
+			return errJobWaiting
+		}
+		return r.Offload(ctx)
+	default:
+		return fmt.Errorf("unknown job kind %q", j.Kind)
+	}
+
+	if r.Offloaded {
+		// The remote copy is now outdated.
+		q.Enqueue(r.Identifier, JobOffload)
+	}
+	return nil
+}
+
+// Close stops all workers, interrupting running jobs which will be resumed on
+// the next start.
+func (q *JobQueue) Close() {
+	q.cancel()
+	q.wg.Wait()
+}
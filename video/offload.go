@@ -0,0 +1,154 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// remoteKey is the object key for a local file.
+func remoteKey(path string) string {
+	return filepath.Base(path)
+}
+
+// remoteFiles lists the files of the record which are stored remotely once
+// offloaded, with their content types. Must be called with r.l held.
+func (r *VideoRecord) remoteFiles() map[string]string {
+	paths := r.Paths()
+	files := make(map[string]string)
+	add := func(have bool, path, contentType string) {
+		if have {
+			files[path] = contentType
+		}
+	}
+	add(r.HaveVideo, paths.VideoPath, "video/mp4")
+	add(r.HaveThumb, paths.ThumbPath, "image/jpeg")
+	add(r.HaveVThumb, paths.VThumbPath, "video/mp4")
+	add(r.HaveSprite, paths.SpritePath, "image/jpeg")
+	add(r.HaveVTT, paths.VTTPath, "text/vtt")
+	return files
+}
+
+// Offload uploads the record's files to remote storage. Local copies are kept
+// until evicted by garbage collection.
+func (r *VideoRecord) Offload(ctx context.Context) error {
+	remote := r.fs.options.Remote
+	if remote == nil {
+		return errors.New("no remote storage configured")
+	}
+	defer r.fs.notifyListeners()
+
+	r.l.Lock()
+	files := r.remoteFiles()
+	r.l.Unlock()
+
+	var size int64
+	for p, contentType := range files {
+		n, err := remote.Upload(ctx, remoteKey(p), p, contentType)
+		if err != nil {
+			return fmt.Errorf("failed to upload %v: %v", p, err)
+		}
+		size += n
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	r.Offloaded = true
+	r.RemoteSize = size
+	if err := r.update(map[string]interface{}{
+		"offloaded":   true,
+		"remote_size": size,
+	}); err != nil {
+		return err
+	}
+	log.Infof("Offloaded %d files (%d bytes) for %v", len(files), size, r.Identifier)
+	return nil
+}
+
+// evictLocal removes the local copies of an offloaded record, except for the
+// thumbnail which is needed to list events. Must be called with r.l held.
+func (r *VideoRecord) evictLocal() {
+	paths := r.Paths()
+	var size int64
+	for p := range r.remoteFiles() {
+		if p == paths.ThumbPath {
+			if fi, err := os.Stat(p); err == nil {
+				size += fi.Size()
+			}
+			continue
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Failed to evict %v: %v", p, err)
+		}
+	}
+	r.LocalEvicted = true
+	r.Size = size
+	if err := r.update(map[string]interface{}{
+		"local_evicted": true,
+		"size":          size,
+	}); err != nil {
+		log.Errorf("Evict %v for %v", err, r.Identifier)
+	}
+	log.Infof("Evicted local copy of offloaded event %v", r.Identifier)
+}
+
+// deleteRemote removes the record's remote objects. Must be called with r.l
+// held.
+func (r *VideoRecord) deleteRemote() {
+	remote := r.fs.options.Remote
+	if !r.Offloaded || remote == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for p := range r.remoteFiles() {
+		if err := remote.Delete(ctx, remoteKey(p)); err != nil {
+			log.Errorf("Failed to delete remote copy of %v: %v", p, err)
+		}
+	}
+}
+
+// OpenRemote reads the remote copy of one of the record's files.
+func (r *VideoRecord) OpenRemote(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	if !r.Offloaded || r.fs.options.Remote == nil {
+		return nil, os.ErrNotExist
+	}
+	return r.fs.options.Remote.Open(ctx, remoteKey(path))
+}
+
+// Open reads the plaintext of one of the record's files, from remote storage
+// if the local copy is gone.
+func (r *VideoRecord) Open(ctx context.Context, path string) (io.ReadSeekCloser, error) {
+	f, err := os.Open(path)
+	if err == nil {
+		return r.fs.decrypt(f)
+	}
+	if os.IsNotExist(err) && r.Offloaded {
+		rf, err := r.OpenRemote(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		return r.fs.decrypt(rf)
+	}
+	return nil, err
+}
+
+// RemoteURL provides a presigned URL for the remote copy of one of the
+// record's files.
+func (r *VideoRecord) RemoteURL(ctx context.Context, path string, expiry time.Duration) (string, error) {
+	if !r.Offloaded || r.fs.options.Remote == nil {
+		return "", os.ErrNotExist
+	}
+	return r.fs.options.Remote.PresignedURL(ctx, remoteKey(path), expiry)
+}
+
+// HasRemote returns whether events are offloaded to remote storage.
+func (f *Filesystem) HasRemote() bool {
+	return f.options.Remote != nil
+}
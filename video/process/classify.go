@@ -53,6 +53,10 @@ type Classifier struct {
 
 	enabled bool
 	l       sync.Mutex
+
+	// Most recent detection locations, guarded by l.
+	boxes     []DetectionBox
+	boxesTime time.Time
 }
 
 func NewClassifier(prototxt, caffeModel []byte) *Classifier {
@@ -83,6 +87,12 @@ type Detection struct {
 	Confidence float32
 }
 
+// DetectionBox is the location of a detection within the classified image.
+type DetectionBox struct {
+	Detection
+	Rect image.Rectangle
+}
+
 func (d Detections) SortedDetections() []Detection {
 	var ss []Detection
 	for k, v := range d {
@@ -126,6 +136,13 @@ func (cl *Classifier) Classify(input gocv.Mat, debug *sink.MJPEGStreamPool) Dete
 		log.Debugf("Classifier ran in %v", time.Now().Sub(start).String())
 	}()
 	output := make(Detections)
+	var boxes []DetectionBox
+	defer func() {
+		cl.l.Lock()
+		defer cl.l.Unlock()
+		cl.boxes = boxes
+		cl.boxesTime = time.Now()
+	}()
 
 	scale := image.Point{X: 300, Y: 300}
 	gocv.Resize(input, &cl.small, scale, 0, 0, gocv.InterpolationLinear)
@@ -169,10 +186,25 @@ func (cl *Classifier) Classify(input gocv.Mat, debug *sink.MJPEGStreamPool) Dete
 		if output[class] < confidence {
 			output[class] = confidence
 		}
+		boxes = append(boxes, DetectionBox{
+			Detection: Detection{class, confidence},
+			Rect:      image.Rect(left, top, right, bottom),
+		})
 	}
 	return output
 }
 
+// RecentDetections returns the detection locations from the last
+// classification, if it ran within maxAge.
+func (cl *Classifier) RecentDetections(maxAge time.Duration) []DetectionBox {
+	cl.l.Lock()
+	defer cl.l.Unlock()
+	if time.Since(cl.boxesTime) > maxAge {
+		return nil
+	}
+	return cl.boxes
+}
+
 func (cl *Classifier) Enable() {
 	cl.l.Lock()
 	defer cl.l.Unlock()
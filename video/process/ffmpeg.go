@@ -0,0 +1,75 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"cam/config"
+	"cam/util"
+	"cam/video/sink"
+)
+
+// runFFmpeg runs ffmpeg to completion, writing to dst via a temporary file
+// which is only moved into place on success.
+func runFFmpeg(dst string, args ...string) error {
+	return runFFmpegContext(context.Background(), dst, args...)
+}
+
+// runFFmpegContext is like runFFmpeg, but kills ffmpeg if ctx is done.
+func runFFmpegContext(ctx context.Context, dst string, args ...string) error {
+	args = append([]string{"-y", "-loglevel", "error"}, args...)
+	args = append(args, dst+ExtTemp)
+	c := exec.CommandContext(ctx, util.LocateFFmpegOrDie(), args...)
+
+	// Allows for debugging ffmpeg in shell.
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+
+	if err := c.Run(); err != nil {
+		os.Remove(dst + ExtTemp)
+		return fmt.Errorf("ffmpeg failed for %v: %v", dst, err)
+	}
+	return os.Rename(dst+ExtTemp, dst)
+}
+
+// Remux copies the streams of a (possibly truncated) video file into a new
+// mp4 container without re-encoding. This recovers any data that is readable
+// from a partially written file.
+func Remux(src, dst string) error {
+	return runFFmpeg(dst,
+		"-i", src,
+		"-c", "copy",
+		// Enable fast-start so videos can be displayed in the browser without
+		// full download.
+		"-movflags", "+faststart",
+		// Explicit format since our active output file will have a special extension.
+		"-f", "mp4",
+	)
+}
+
+// ExtractThumb writes a thumbnail image using the first frame of a video file.
+func ExtractThumb(src, dst string) error {
+	return runFFmpeg(dst,
+		"-i", src,
+		"-frames:v", "1",
+		"-vf", "scale=320:180",
+		"-f", "image2",
+	)
+}
+
+// Reencode converts a video file using an encoding profile. src and dst may be
+// the same file, which is only replaced on success.
+func Reencode(ctx context.Context, src, dst string, profile config.EncodingProfile) error {
+	args := []string{"-i", src}
+	if vf := sink.ScaleFilter(profile); vf != "" {
+		args = append(args, "-vf", vf)
+	}
+	args = append(args, sink.EncoderArgs(profile)...)
+	args = append(args,
+		"-movflags", "+faststart",
+		"-f", "mp4",
+	)
+	return runFFmpegContext(ctx, dst, args...)
+}
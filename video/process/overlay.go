@@ -0,0 +1,184 @@
+package process
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"sync"
+	"time"
+
+	"cam/config"
+	"cam/video/source"
+
+	log "github.com/sirupsen/logrus"
+	"gocv.io/x/gocv"
+)
+
+const (
+	defaultTimeFormat = "2006-01-02 15:04:05 MST"
+
+	// detectionMaxAge is how long detection boxes remain visible. The
+	// classifier runs at a low frame rate so boxes must outlive a single frame.
+	detectionMaxAge = 2 * time.Second
+)
+
+var (
+	colorText      = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+	colorBG        = color.RGBA{R: 0, G: 0, B: 0, A: 255}
+	colorRecording = color.RGBA{R: 255, G: 0, B: 0, A: 255}
+	colorDetection = color.RGBA{R: 0, G: 255, B: 0, A: 255}
+)
+
+// Overlays draws configurable information on frames for each output. The
+// configuration is read on every frame, so changes take effect immediately.
+type Overlays struct {
+	classifier *Classifier
+
+	// Output images, reused across frames. Only accessed from Apply.
+	bufs      map[string]*gocv.Mat
+	locations map[string]*time.Location
+
+	recording bool
+	l         sync.Mutex
+}
+
+// NewOverlays creates an overlay stage. If classifier is set, it provides
+// detections to draw.
+func NewOverlays(classifier *Classifier) *Overlays {
+	return &Overlays{
+		classifier: classifier,
+		bufs:       make(map[string]*gocv.Mat),
+		locations:  make(map[string]*time.Location),
+	}
+}
+
+// SetRecording toggles the recording indicator.
+func (o *Overlays) SetRecording(recording bool) {
+	o.l.Lock()
+	defer o.l.Unlock()
+	o.recording = recording
+}
+
+func (o *Overlays) isRecording() bool {
+	o.l.Lock()
+	defer o.l.Unlock()
+	return o.recording
+}
+
+func (o *Overlays) location(tz string) *time.Location {
+	if tz == "" {
+		return time.Local
+	}
+	if loc, ok := o.locations[tz]; ok {
+		return loc
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Errorf("Invalid overlay timezone %q: %v", tz, err)
+		loc = time.Local
+	}
+	o.locations[tz] = loc
+	return loc
+}
+
+// Apply returns the image for an output with its overlay drawn. If the output
+// has no overlay, the input is returned unmodified. Otherwise, the returned
+// image is owned by Overlays and is only valid until the next call to Apply
+// for the same output; the caller must not close it. Must be called from a
+// single goroutine.
+func (o *Overlays) Apply(output string, img source.Image) source.Image {
+	cfg := config.Get()
+	oc, ok := cfg.GetOverlay(output)
+	if !ok {
+		return img
+	}
+
+	buf, ok := o.bufs[output]
+	if !ok {
+		m := gocv.NewMat()
+		buf = &m
+		o.bufs[output] = buf
+	}
+	img.Mat.CopyTo(buf)
+	out := source.Image{Mat: *buf, Time: img.Time}
+
+	if oc.Detections && o.classifier != nil {
+		for _, d := range o.classifier.RecentDetections(detectionMaxAge) {
+			gocv.Rectangle(&out.Mat, d.Rect, colorDetection, 2)
+			label := fmt.Sprintf("%s %.0f%%", d.Class, d.Confidence*100)
+			gocv.PutText(&out.Mat, label, d.Rect.Min.Add(image.Point{X: 2, Y: -4}), gocv.FontHersheySimplex, 0.5, colorDetection, 1)
+		}
+	}
+
+	format := oc.TimeFormat
+	if format == "" {
+		format = defaultTimeFormat
+	}
+	ts := img.Time.In(o.location(oc.Timezone)).Format(format)
+
+	var lines []string
+	for _, l := range oc.Lines {
+		l = strings.ReplaceAll(l, "{camera}", cfg.GetCameraName())
+		l = strings.ReplaceAll(l, "{time}", ts)
+		lines = append(lines, l)
+	}
+	recording := oc.RecordingIndicator && o.isRecording()
+	if recording {
+		lines = append(lines, "REC")
+	}
+	drawLines(&out.Mat, lines, oc, recording)
+	return out
+}
+
+// drawLines draws each line of text on a solid background, stacked from the
+// configured corner. The final line is highlighted if recording.
+func drawLines(mat *gocv.Mat, lines []string, oc config.OverlayConfig, recording bool) {
+	font := gocv.FontHersheySimplex
+	scale := oc.FontScale
+	if scale == 0 {
+		scale = 0.5
+	}
+	thickness := 1
+	pad := 2
+
+	right := strings.HasSuffix(oc.Position, "right")
+	bottom := strings.HasPrefix(oc.Position, "bottom")
+	if bottom {
+		// Draw from the corner outwards.
+		for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+			lines[i], lines[j] = lines[j], lines[i]
+		}
+	}
+
+	y := 0
+	for i, text := range lines {
+		sz := gocv.GetTextSize(text, font, scale, thickness)
+		box := image.Rectangle{Max: image.Point{X: sz.X + pad*2, Y: sz.Y + pad*2}}
+		if right {
+			box = box.Add(image.Point{X: mat.Cols() - box.Max.X})
+		}
+		if bottom {
+			box = box.Add(image.Point{Y: mat.Rows() - y - box.Max.Y})
+		} else {
+			box = box.Add(image.Point{Y: y})
+		}
+		y += box.Dy()
+
+		fg := colorText
+		isRec := recording && ((bottom && i == 0) || (!bottom && i == len(lines)-1))
+		if isRec {
+			fg = colorRecording
+		}
+		gocv.Rectangle(mat, box, colorBG, -1)
+		gocv.PutText(mat, text, image.Point{X: box.Min.X + pad, Y: box.Min.Y + sz.Y + pad}, font, scale, fg, thickness)
+	}
+}
+
+// Close releases the output images.
+func (o *Overlays) Close() {
+	for _, m := range o.bufs {
+		m.Close()
+	}
+	o.bufs = make(map[string]*gocv.Mat)
+}
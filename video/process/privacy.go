@@ -0,0 +1,114 @@
+package process
+
+import (
+	"image"
+	"image/color"
+
+	"cam/config"
+	"cam/video/sink"
+	"cam/video/source"
+
+	"gocv.io/x/gocv"
+)
+
+const (
+	// pixelateBlock is the size of each block in pixelated regions.
+	pixelateBlock = 16
+)
+
+var (
+	colorMaskOutline = color.RGBA{R: 255, G: 255, B: 0, A: 255}
+)
+
+// PrivacyMask hides configured regions of each frame. Masks are reloaded
+// whenever the configuration changes.
+type PrivacyMask struct {
+	// debug, if set, receives masked frames with the mask outlines drawn.
+	debug *sink.MJPEGStream
+
+	cfg   *config.Config
+	masks []config.PrivacyMask
+
+	small, pixelated, draw gocv.Mat
+}
+
+func NewPrivacyMask(debug *sink.MJPEGStream) *PrivacyMask {
+	return &PrivacyMask{
+		debug:     debug,
+		small:     gocv.NewMat(),
+		pixelated: gocv.NewMat(),
+		draw:      gocv.NewMat(),
+	}
+}
+
+// Apply hides the masked regions of the image in place. Must be called from a
+// single goroutine.
+func (p *PrivacyMask) Apply(img source.Image) {
+	if cfg := config.Get(); cfg != p.cfg {
+		p.cfg = cfg
+		p.masks = cfg.PrivacyMasks
+	}
+	if len(p.masks) == 0 {
+		return
+	}
+
+	bounds := image.Rect(0, 0, img.Mat.Cols(), img.Mat.Rows())
+	for _, m := range p.masks {
+		if len(m.Points) < 3 {
+			continue
+		}
+		if m.Mode == "pixelate" {
+			p.pixelate(&img.Mat, m.Points, bounds)
+		} else {
+			pv := gocv.NewPointsVectorFromPoints([][]image.Point{m.Points})
+			gocv.FillPoly(&img.Mat, pv, colorBG)
+			pv.Close()
+		}
+	}
+
+	if p.debug != nil && p.debug.Active() {
+		img.Mat.CopyTo(&p.draw)
+		for _, m := range p.masks {
+			pv := gocv.NewPointsVectorFromPoints([][]image.Point{m.Points})
+			gocv.Polylines(&p.draw, pv, true, colorMaskOutline, 2)
+			pv.Close()
+		}
+		p.debug.Put(p.draw)
+	}
+}
+
+// pixelate replaces the polygon with a low resolution version of itself.
+func (p *PrivacyMask) pixelate(mat *gocv.Mat, points []image.Point, bounds image.Rectangle) {
+	pv := gocv.NewPointVectorFromPoints(points)
+	rect := gocv.BoundingRect(pv).Intersect(bounds)
+	pv.Close()
+	if rect.Empty() {
+		return
+	}
+
+	region := mat.Region(rect)
+	defer region.Close()
+
+	sz := image.Point{X: (rect.Dx() + pixelateBlock - 1) / pixelateBlock, Y: (rect.Dy() + pixelateBlock - 1) / pixelateBlock}
+	gocv.Resize(region, &p.small, sz, 0, 0, gocv.InterpolationArea)
+	gocv.Resize(p.small, &p.pixelated, rect.Size(), 0, 0, gocv.InterpolationNearestNeighbor)
+
+	// Limit the effect to the polygon itself rather than its bounding box.
+	shifted := make([]image.Point, len(points))
+	for i, pt := range points {
+		shifted[i] = pt.Sub(rect.Min)
+	}
+	poly := gocv.Zeros(rect.Dy(), rect.Dx(), gocv.MatTypeCV8U)
+	defer poly.Close()
+	spv := gocv.NewPointsVectorFromPoints([][]image.Point{shifted})
+	gocv.FillPoly(&poly, spv, colorText)
+	spv.Close()
+
+	p.pixelated.CopyToWithMask(&region, poly)
+}
+
+func (p *PrivacyMask) Close() {
+	p.small.Close()
+	p.pixelated.Close()
+	p.draw.Close()
+}
@@ -0,0 +1,103 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"os"
+	"strings"
+	"time"
+
+	"cam/config"
+)
+
+const (
+	// defaultSpriteInterval is the time between sprite sheet frames if not
+	// configured.
+	defaultSpriteInterval = 2 * time.Second
+
+	// Sprite sheet layout. Long videos use a longer interval to stay within
+	// spriteMaxTiles.
+	spriteTileWidth = 160
+	spriteColumns   = 10
+	spriteMaxTiles  = 100
+)
+
+// spriteLayout determines the interval and tile grid for a video.
+func spriteLayout(duration time.Duration) (interval time.Duration, tiles, cols, rows int) {
+	interval = defaultSpriteInterval
+	if s := config.Get().SpriteIntervalSec; s > 0 {
+		interval = time.Duration(s) * time.Second
+	}
+	if duration > interval*spriteMaxTiles {
+		interval = (duration + spriteMaxTiles - 1) / spriteMaxTiles
+	}
+	tiles = int((duration + interval - 1) / interval)
+	if tiles < 1 {
+		tiles = 1
+	}
+	cols = tiles
+	if cols > spriteColumns {
+		cols = spriteColumns
+	}
+	rows = (tiles + cols - 1) / cols
+	return
+}
+
+// Sprites creates a sprite sheet of frames from src at spriteDst, and a
+// WebVTT thumbnail track at vttDst mapping each time range to its tile.
+// spriteURL is how the track refers to the sprite sheet, relative to the
+// track itself.
+func (f *VThumbProducer) Sprites(ctx context.Context, src, spriteDst, vttDst, spriteURL string, duration time.Duration) error {
+	interval, tiles, cols, rows := spriteLayout(duration)
+	err := runFFmpegContext(ctx, spriteDst,
+		"-i", src,
+		"-vf", fmt.Sprintf("fps=1/%.3f,scale=%d:-2,tile=%dx%d", interval.Seconds(), spriteTileWidth, cols, rows),
+		"-frames:v", "1",
+		"-q:v", "5",
+		// Explicit format.
+		"-f", "image2",
+	)
+	if err != nil {
+		return err
+	}
+	return writeSpriteVTT(spriteDst, vttDst, spriteURL, interval, duration, tiles, cols, rows)
+}
+
+// writeSpriteVTT writes the WebVTT track for a sprite sheet. The tile size is
+// taken from the sprite sheet, since the height depends on the video.
+func writeSpriteVTT(sprite, dst, spriteURL string, interval, duration time.Duration, tiles, cols, rows int) error {
+	sf, err := os.Open(sprite)
+	if err != nil {
+		return err
+	}
+	cfg, _, err := image.DecodeConfig(sf)
+	sf.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read sprite sheet: %v", err)
+	}
+	w, h := cfg.Width/cols, cfg.Height/rows
+
+	var b strings.Builder
+	b.WriteString("WEBVTT\n")
+	for i := 0; i < tiles; i++ {
+		start := time.Duration(i) * interval
+		end := start + interval
+		if duration > 0 && end > duration {
+			end = duration
+		}
+		fmt.Fprintf(&b, "\n%s --> %s\n%s#xywh=%d,%d,%d,%d\n",
+			vttTimestamp(start), vttTimestamp(end), spriteURL, (i%cols)*w, (i/cols)*h, w, h)
+	}
+
+	if err := os.WriteFile(dst+ExtTemp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(dst+ExtTemp, dst)
+}
+
+func vttTimestamp(d time.Duration) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
@@ -0,0 +1,91 @@
+package process
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cam/config"
+	"cam/video/sink"
+)
+
+// TrimInput is part of a source video to include in a clip.
+type TrimInput struct {
+	Path string
+
+	// Start and End are offsets into the video. A zero End includes the rest
+	// of the video.
+	Start, End time.Duration
+}
+
+// TrimOptions controls how a clip is cut.
+type TrimOptions struct {
+	// Exact re-encodes the clip using Profile so that it starts exactly at the
+	// requested offset. Otherwise streams are copied, and each input starts at
+	// the keyframe preceding its offset.
+	Exact   bool
+	Profile config.EncodingProfile
+
+	// Timestamp, if set, is the wall clock time of the first frame. The time
+	// is burned into the video, which implies Exact. Gaps between inputs are
+	// not reflected in the burned-in time.
+	Timestamp time.Time
+}
+
+// Trim joins parts of one or more videos into a single mp4 file.
+func Trim(ctx context.Context, inputs []TrimInput, dst string, opts TrimOptions) error {
+	if len(inputs) == 0 {
+		return fmt.Errorf("no inputs for %v", dst)
+	}
+
+	// The concat demuxer takes a list of files with in and out points.
+	list, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.txt")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(list.Name())
+	for _, in := range inputs {
+		abs, err := filepath.Abs(in.Path)
+		if err != nil {
+			list.Close()
+			return err
+		}
+		fmt.Fprintf(list, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+		if in.Start > 0 {
+			fmt.Fprintf(list, "inpoint %.3f\n", in.Start.Seconds())
+		}
+		if in.End > 0 {
+			fmt.Fprintf(list, "outpoint %.3f\n", in.End.Seconds())
+		}
+	}
+	if err := list.Close(); err != nil {
+		return err
+	}
+
+	args := []string{"-f", "concat", "-safe", "0", "-i", list.Name(), "-map", "0:v"}
+	if opts.Exact || !opts.Timestamp.IsZero() {
+		var filters []string
+		if vf := sink.ScaleFilter(opts.Profile); vf != "" {
+			filters = append(filters, vf)
+		}
+		if !opts.Timestamp.IsZero() {
+			filters = append(filters, fmt.Sprintf(
+				"drawtext=text='%%{pts\\:localtime\\:%d}':x=8:y=8:fontsize=24:fontcolor=white:box=1:boxcolor=black@0.5",
+				opts.Timestamp.Unix()))
+		}
+		if len(filters) > 0 {
+			args = append(args, "-vf", strings.Join(filters, ","))
+		}
+		args = append(args, sink.EncoderArgs(opts.Profile)...)
+	} else {
+		args = append(args, "-c", "copy", "-avoid_negative_ts", "make_zero")
+	}
+	args = append(args,
+		"-movflags", "+faststart",
+		"-f", "mp4",
+	)
+	return runFFmpegContext(ctx, dst, args...)
+}
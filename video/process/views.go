@@ -0,0 +1,93 @@
+package process
+
+import (
+	"image"
+
+	"cam/config"
+	"cam/video/sink"
+	"cam/video/source"
+
+	"gocv.io/x/gocv"
+)
+
+// viewStreamPrefix distinguishes view streams from the built-in streams.
+const viewStreamPrefix = "view-"
+
+// Views publishes the virtual views from the configuration as MJPEG streams.
+// Streams are added and removed as the configuration changes.
+type Views struct {
+	server  *sink.MJPEGServer
+	streams map[string]*sink.MJPEGStream
+
+	cfg    *config.Config
+	scaled gocv.Mat
+}
+
+func NewViews(server *sink.MJPEGServer) *Views {
+	return &Views{
+		server:  server,
+		streams: make(map[string]*sink.MJPEGStream),
+		scaled:  gocv.NewMat(),
+	}
+}
+
+func (v *Views) reload(cfg *config.Config) {
+	v.cfg = cfg
+	for name, s := range v.streams {
+		if _, ok := cfg.Views[name]; !ok {
+			s.Close()
+			delete(v.streams, name)
+		}
+	}
+	for name := range cfg.Views {
+		if _, ok := v.streams[name]; !ok {
+			v.streams[name] = v.server.NewStream(sink.MJPEGID{Name: viewStreamPrefix + name})
+		}
+	}
+}
+
+// Put crops the image for each view. Must be called from a single goroutine.
+func (v *Views) Put(img source.Image) {
+	if cfg := config.Get(); cfg != v.cfg {
+		v.reload(cfg)
+	}
+
+	size := image.Point{X: img.Mat.Cols(), Y: img.Mat.Rows()}
+	for name, s := range v.streams {
+		if !s.Active() {
+			continue
+		}
+		vc := v.cfg.Views[name]
+		rect := vc.Crop.Rect(size)
+		region := img.Mat.Region(rect)
+		if sz := viewSize(vc, rect.Size()); sz != rect.Size() {
+			gocv.Resize(region, &v.scaled, sz, 0, 0, gocv.InterpolationLinear)
+			s.Put(v.scaled)
+		} else {
+			s.Put(region)
+		}
+		region.Close()
+	}
+}
+
+// viewSize returns the output size of a view, preserving the aspect ratio if
+// only one dimension is configured.
+func viewSize(vc config.ViewConfig, crop image.Point) image.Point {
+	switch {
+	case vc.Width > 0 && vc.Height > 0:
+		return image.Point{X: vc.Width, Y: vc.Height}
+	case vc.Width > 0:
+		return image.Point{X: vc.Width, Y: crop.Y * vc.Width / crop.X}
+	case vc.Height > 0:
+		return image.Point{X: crop.X * vc.Height / crop.Y, Y: vc.Height}
+	}
+	return crop
+}
+
+func (v *Views) Close() {
+	for _, s := range v.streams {
+		s.Close()
+	}
+	v.streams = make(map[string]*sink.MJPEGStream)
+	v.scaled.Close()
+}
@@ -0,0 +1,300 @@
+package video
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"cam/video/process"
+	"cam/video/sink"
+
+	"github.com/pillash/mp4util"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReconcileReport summarizes the changes made by a consistency check. Each
+// field lists the affected event identifiers.
+type ReconcileReport struct {
+	TempFinalized    []string
+	TempRemoved      []string
+	SizeCorrected    []string
+	ThumbsCreated    []string
+	VThumbsScheduled []string
+	SpritesScheduled []string
+	RecordsRemoved   []string
+	OrphansImported  []string
+	OrphansRemoved   []string
+
+	Elapsed time.Duration
+}
+
+// diskFiles tracks which files are present for a single identifier, keyed by
+// file extension (which may include a temporary suffix).
+type diskFiles map[string]bool
+
+var knownExts = []string{ExtVideo, ExtThumb, ExtVThumb, ExtSprite, ExtVTT}
+
+// parseFilename splits a filename in BasePath into an identifier and
+// extension. Files not created by this application are rejected. Temporary
+// files (including intermediate ffmpeg segments) keep their full suffix as the
+// extension.
+func parseFilename(name string) (id, ext string, ok bool) {
+	for _, e := range knownExts {
+		i := strings.Index(name, e)
+		if i < 0 {
+			continue
+		}
+		id, ext = name[:i], name[i:]
+		if ext != e && !strings.HasSuffix(ext, sink.ExtTemp) {
+			continue
+		}
+		if _, err := time.Parse(FileTimeLayout, id); err != nil {
+			return "", "", false
+		}
+		return id, ext, true
+	}
+	return "", "", false
+}
+
+// Reconcile brings the database and the contents of BasePath back into
+// agreement. This cleans up after a crash mid-recording: temporary video
+// files are finalized (or removed if unreadable), sizes are recomputed,
+// missing thumbnails are regenerated, records without video are removed
+// (unless they record why recording failed), and orphan files without a record
+// are imported or removed. Records which are currently being written, by a
+// recording or a job, are not touched.
+// If jobs is set, missing video thumbnails and sprite sheets will be scheduled
+// for creation.
+func (f *Filesystem) Reconcile(jobs *JobQueue) (*ReconcileReport, error) {
+	f.maintenance.Lock()
+	defer f.maintenance.Unlock()
+
+	start := time.Now()
+	report := &ReconcileReport{}
+
+	// Records created after the listing have no files in it. Stored times may
+	// be truncated to the second.
+	listedAt := time.Now().Truncate(time.Second)
+	entries, err := os.ReadDir(f.options.BasePath)
+	if err != nil {
+		return nil, err
+	}
+
+	ne := f.notifyListenersInBatch()
+	defer func() {
+		ne <- true
+	}()
+
+	files := make(map[string]diskFiles)
+	// Identifiers which were recording or had jobs running when listed are
+	// left alone even if they finish meanwhile, since their files are not in
+	// the listing.
+	skipped := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		id, ext, ok := parseFilename(e.Name())
+		if !ok {
+			continue
+		}
+		if f.busy(id) {
+			skipped[id] = true
+			continue
+		}
+		if files[id] == nil {
+			files[id] = make(diskFiles)
+		}
+		files[id][ext] = true
+	}
+
+	// Finalize or remove temporary files left behind by an interrupted process.
+	for id, df := range files {
+		for ext := range df {
+			if !strings.HasSuffix(ext, sink.ExtTemp) {
+				continue
+			}
+			p := filepath.Join(f.options.BasePath, id+ext)
+			if ext == ExtVideo+sink.ExtTemp && !df[ExtVideo] {
+				dst := filepath.Join(f.options.BasePath, id+ExtVideo)
+				if err := process.Remux(p, dst); err != nil {
+					log.Warnf("Unable to recover interrupted video %v: %v", p, err)
+				} else {
+					if err := f.seal(dst); err != nil {
+						log.Errorf("Failed to encrypt recovered video %v: %v", dst, err)
+					}
+					log.Infof("Recovered interrupted video %v", p)
+					df[ExtVideo] = true
+					report.TempFinalized = append(report.TempFinalized, id)
+				}
+			}
+			if err := os.Remove(p); err != nil {
+				log.Errorf("Failed to remove temporary file %v: %v", p, err)
+				continue
+			}
+			delete(df, ext)
+			report.TempRemoved = append(report.TempRemoved, id)
+		}
+	}
+
+	// Trashed records keep their files as they are until purged.
+	for _, r := range f.GetTrash() {
+		delete(files, r.Identifier)
+	}
+
+	for _, r := range f.GetRecords(&RecordsFilter{}) {
+		if skipped[r.Identifier] || f.busy(r.Identifier) || !r.CreatedAt.Before(listedAt) {
+			continue
+		}
+		df := files[r.Identifier]
+		delete(files, r.Identifier)
+		if r.LocalEvicted {
+			// Only the thumbnail is expected locally; the rest is remote.
+			continue
+		}
+		if !r.HaveVideo && r.RetentionTier > 0 && (df[ExtThumb] || df[ExtVThumb]) {
+			// Video was removed by retention; only previews remain.
+			continue
+		}
+		if !df[ExtVideo] && !r.HaveVideo && r.HaveError {
+			// Recording failed or was refused; the record shows what was
+			// missed.
+			continue
+		}
+		if !df[ExtVideo] {
+			// Nothing worth keeping; remove whatever is left of the event.
+			r.HaveVideo = false
+			r.HaveThumb = df[ExtThumb]
+			r.HaveVThumb = df[ExtVThumb]
+			r.HaveSprite = df[ExtSprite]
+			r.HaveVTT = df[ExtVTT]
+			r.Delete()
+			report.RecordsRemoved = append(report.RecordsRemoved, r.Identifier)
+			continue
+		}
+		f.reconcileRecord(r, df, jobs, report)
+	}
+
+	// Anything remaining has no corresponding database record.
+	for id, df := range files {
+		if !df[ExtVideo] {
+			for ext := range df {
+				p := filepath.Join(f.options.BasePath, id+ext)
+				if err := os.Remove(p); err != nil {
+					log.Errorf("Failed to remove orphan file %v: %v", p, err)
+				}
+			}
+			report.OrphansRemoved = append(report.OrphansRemoved, id)
+			continue
+		}
+		t, _ := time.Parse(FileTimeLayout, id)
+		r := &VideoRecord{
+			TriggeredAt: t,
+			Identifier:  id,
+			fs:          f,
+		}
+		if err := f.db.Debug().Create(r).Error; err != nil {
+			log.Errorf("Failed to import orphan %v: %v", id, err)
+			continue
+		}
+		f.reconcileRecord(r, df, jobs, report)
+		report.OrphansImported = append(report.OrphansImported, id)
+	}
+
+	report.Elapsed = time.Since(start)
+	log.Infof("Reconciliation completed in %v: %d temp finalized, %d records removed, %d orphans imported, %d orphans removed",
+		report.Elapsed, len(report.TempFinalized), len(report.RecordsRemoved), len(report.OrphansImported), len(report.OrphansRemoved))
+	return report, nil
+}
+
+// reconcileRecord updates a record which has a video file on disk so that its
+// flags and size match the filesystem, regenerating thumbnails as needed.
+func (f *Filesystem) reconcileRecord(r *VideoRecord, df diskFiles, jobs *JobQueue, report *ReconcileReport) {
+	paths := r.Paths()
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	// The video is only decrypted if it needs to be read.
+	var plain string
+	cleanup := func() {}
+	defer func() { cleanup() }()
+	plainVideo := func() string {
+		if plain == "" {
+			p, done, err := f.plainPath(paths.VideoPath)
+			if err != nil {
+				log.Errorf("Failed to decrypt %v: %v", paths.VideoPath, err)
+				p, done = paths.VideoPath, func() {}
+			}
+			plain, cleanup = p, done
+		}
+		return plain
+	}
+
+	if !r.HaveVideo {
+		ds, err := mp4util.Duration(plainVideo())
+		if err != nil {
+			log.Errorf("Failed to get video duration %v: %v", paths.VideoPath, err)
+		}
+		r.HaveVideo = true
+		r.VideoDurationSec = ds
+		if sum, err := f.hashFile(paths.VideoPath); err != nil {
+			log.Errorf("Failed to hash video %v: %v", paths.VideoPath, err)
+		} else {
+			r.VideoSHA256 = sum
+		}
+	}
+
+	if !df[ExtThumb] {
+		if err := process.ExtractThumb(plainVideo(), paths.ThumbPath); err != nil {
+			log.Errorf("Failed to regenerate thumbnail for %v: %v", r.Identifier, err)
+		} else {
+			if err := f.seal(paths.ThumbPath); err != nil {
+				log.Errorf("Failed to encrypt %v: %v", paths.ThumbPath, err)
+			}
+			df[ExtThumb] = true
+			report.ThumbsCreated = append(report.ThumbsCreated, r.Identifier)
+		}
+	}
+	r.HaveThumb = df[ExtThumb]
+	r.HaveVThumb = df[ExtVThumb]
+	// The track is useless without its sprite sheet, so require both.
+	r.HaveSprite = df[ExtSprite] && df[ExtVTT]
+	r.HaveVTT = r.HaveSprite
+
+	var size int64
+	for ext, p := range map[string]string{
+		ExtVideo:  paths.VideoPath,
+		ExtThumb:  paths.ThumbPath,
+		ExtVThumb: paths.VThumbPath,
+		ExtSprite: paths.SpritePath,
+		ExtVTT:    paths.VTTPath,
+	} {
+		if !df[ext] {
+			continue
+		}
+		if fi, err := os.Stat(p); err == nil {
+			size += fi.Size()
+		}
+	}
+	if size != r.Size {
+		r.Size = size
+		report.SizeCorrected = append(report.SizeCorrected, r.Identifier)
+	}
+
+	if err := f.db.Debug().Save(r).Error; err != nil {
+		log.Errorf("Reconcile.Save %v for %v", err, r.Identifier)
+		return
+	}
+
+	if jobs == nil {
+		return
+	}
+	if !r.HaveVThumb && jobs.Enqueue(r.Identifier, JobVThumb) {
+		report.VThumbsScheduled = append(report.VThumbsScheduled, r.Identifier)
+	}
+	if !r.HaveSprite && jobs.Enqueue(r.Identifier, JobSprites) {
+		report.SpritesScheduled = append(report.SpritesScheduled, r.Identifier)
+	}
+}
@@ -0,0 +1,37 @@
+package video
+
+import "testing"
+
+func TestParseFilename(t *testing.T) {
+	const id = "20220901-101112-0700"
+	for _, tc := range []struct {
+		name    string
+		id, ext string
+		ok      bool
+	}{
+		{id + ExtVideo, id, ExtVideo, true},
+		{id + ExtThumb, id, ExtThumb, true},
+		{id + ExtVThumb, id, ExtVThumb, true},
+		{id + ExtSprite, id, ExtSprite, true},
+		{id + ExtVTT, id, ExtVTT, true},
+		{"20220901-101112Z" + ExtVideo, "20220901-101112Z", ExtVideo, true},
+
+		// Temporary files keep their full suffix.
+		{id + ExtVideo + ".temp", id, ExtVideo + ".temp", true},
+		{id + ExtVideo + ".1.temp", id, ExtVideo + ".1.temp", true},
+		{id + ExtVideo + ".joined.temp", id, ExtVideo + ".joined.temp", true},
+		{id + ExtThumb + ".crypt.temp", id, ExtThumb + ".crypt.temp", true},
+
+		// Not created by this application.
+		{"notes.txt", "", "", false},
+		{"holiday" + ExtVideo, "", "", false},
+		{id + ExtVideo + ".bak", "", "", false},
+		{"20221301-101112-0700" + ExtVideo, "", "", false},
+		{id + ".mp4", "", "", false},
+	} {
+		id, ext, ok := parseFilename(tc.name)
+		if id != tc.id || ext != tc.ext || ok != tc.ok {
+			t.Errorf("parseFilename(%q) = %q, %q, %v; want %q, %q, %v", tc.name, id, ext, ok, tc.id, tc.ext, tc.ok)
+		}
+	}
+}
@@ -7,6 +7,8 @@ import (
 
 	"cam/video/process"
 	"cam/video/source"
+
+	log "github.com/sirupsen/logrus"
 )
 
 type RecorderOptions struct {
@@ -58,6 +60,9 @@ func NewRecorder(p *VideoSinkProducer, o *RecorderOptions) *Recorder {
 				panic("expected to be in state recording")
 			}
 			out.Close()
+			if err := out.Err(); err != nil {
+				log.Errorf("Recording %v finished with errors: %v", out.Record.Identifier, err)
+			}
 			for _, l := range r.Listeners {
 				l.StopRecording(out.Record)
 			}
@@ -101,6 +106,9 @@ func NewRecorder(p *VideoSinkProducer, o *RecorderOptions) *Recorder {
 			case c := <-r.close:
 				if recording {
 					out.Close()
+					if err := out.Err(); err != nil {
+						log.Errorf("Recording %v finished with errors: %v", out.Record.Identifier, err)
+					}
 				}
 				r.buf.Close()
 				c <- true
@@ -153,3 +161,17 @@ func (t *ClassifierRecordTrigger) StartRecording(vr *VideoRecord) {
 func (t *ClassifierRecordTrigger) StopRecording(vr *VideoRecord) {
 	t.Classifier.Disable()
 }
+
+// OverlayRecordTrigger shows the recording indicator in overlays while
+// recording.
+type OverlayRecordTrigger struct {
+	Overlays *process.Overlays
+}
+
+func (t *OverlayRecordTrigger) StartRecording(vr *VideoRecord) {
+	t.Overlays.SetRecording(true)
+}
+
+func (t *OverlayRecordTrigger) StopRecording(vr *VideoRecord) {
+	t.Overlays.SetRecording(false)
+}
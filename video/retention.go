@@ -0,0 +1,143 @@
+package video
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"cam/config"
+	"cam/video/process"
+
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// EnqueueRetention adds jobs for events which have reached a retention tier
+// they have not yet been moved to.
+func (q *JobQueue) EnqueueRetention() int {
+	cfg := config.Get()
+	if len(cfg.RetentionTiers) == 0 {
+		return 0
+	}
+	var n int
+	for _, r := range q.fs.GetRecords(&RecordsFilter{}) {
+		if !r.HaveVideo || r.LocalEvicted || r.Pinned || r.Recording() {
+			continue
+		}
+		if cfg.RetentionTierFor(time.Since(r.TriggeredAt)) > r.RetentionTier && q.Enqueue(r.Identifier, JobRetention) {
+			n++
+		}
+	}
+	return n
+}
+
+// applyRetention moves a record to the retention tier for its age. src is the
+// plaintext of the video.
+func (q *JobQueue) applyRetention(ctx context.Context, r *VideoRecord, src string) error {
+	// The record may have been pinned since it was looked up.
+	current := &VideoRecord{}
+	err := q.fs.db.Select("pinned").First(current, r.ID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return errRecordGone
+	}
+	if err != nil {
+		return err
+	}
+	cfg := config.Get()
+	tier := cfg.RetentionTierFor(time.Since(r.TriggeredAt))
+	if tier <= r.RetentionTier || current.Pinned {
+		return nil
+	}
+	t := cfg.RetentionTiers[tier-1]
+	paths := r.Paths()
+
+	switch t.Action {
+	case config.RetentionReencode:
+		profile, err := cfg.GetEncodingProfile(t.EncodingProfile)
+		if err != nil {
+			return err
+		}
+		if err := process.Reencode(ctx, src, paths.VideoPath, profile); err != nil {
+			return err
+		}
+		if err := r.rehash(); err != nil {
+			return err
+		}
+		if err := r.UpdateSize(); err != nil {
+			return err
+		}
+		r.l.Lock()
+		defer r.l.Unlock()
+		r.RetentionTier = tier
+		return r.update(map[string]interface{}{"retention_tier": tier})
+	case config.RetentionPreviews:
+		return r.dropVideo(tier)
+	}
+	return fmt.Errorf("unknown retention action %q", t.Action)
+}
+
+// dropVideo removes everything except the thumbnail and video thumbnail.
+func (r *VideoRecord) dropVideo(tier int) error {
+	defer r.fs.notifyListeners()
+
+	r.l.Lock()
+	defer r.l.Unlock()
+
+	paths := r.Paths()
+	var drop []string
+	if r.HaveVideo {
+		drop = append(drop, paths.VideoPath)
+	}
+	if r.HaveSprite {
+		drop = append(drop, paths.SpritePath)
+	}
+	if r.HaveVTT {
+		drop = append(drop, paths.VTTPath)
+	}
+	for _, p := range drop {
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if r.Offloaded && r.fs.options.Remote != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			err := r.fs.options.Remote.Delete(ctx, remoteKey(p))
+			cancel()
+			if err != nil {
+				log.Errorf("Failed to delete remote copy of %v: %v", p, err)
+			}
+		}
+	}
+
+	r.HaveVideo = false
+	r.HaveSprite = false
+	r.HaveVTT = false
+	r.VideoSHA256 = ""
+	r.RetentionTier = tier
+
+	var size int64
+	for _, p := range []string{paths.ThumbPath, paths.VThumbPath} {
+		if fi, err := os.Stat(p); err == nil {
+			size += fi.Size()
+		}
+	}
+	r.Size = size
+	if r.Offloaded {
+		// Only the previews remain remotely, uploaded as they are locally.
+		r.RemoteSize = size
+	}
+	if err := r.update(map[string]interface{}{
+		"have_video":     false,
+		"have_sprite":    false,
+		"have_vtt":       false,
+		"video_sha256":   "",
+		"retention_tier": tier,
+		"size":           size,
+		"remote_size":    r.RemoteSize,
+	}); err != nil {
+		return err
+	}
+	log.Infof("Removed video of %v, keeping previews only", r.Identifier)
+	return nil
+}
@@ -0,0 +1,94 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"cam/config"
+)
+
+// ScaleFilter returns the ffmpeg video filter for the output size of the
+// profile, or an empty string if the source size should be kept.
+func ScaleFilter(p config.EncodingProfile) string {
+	if p.Width == 0 && p.Height == 0 {
+		return ""
+	}
+	w, h := p.Width, p.Height
+	// -2 preserves aspect ratio while keeping the dimension even, which most
+	// encoders require.
+	if w == 0 {
+		w = -2
+	}
+	if h == 0 {
+		h = -2
+	}
+	return fmt.Sprintf("scale=%d:%d", w, h)
+}
+
+// EncoderArgs converts the profile to ffmpeg output arguments, excluding
+// scaling (see ScaleFilter).
+func EncoderArgs(p config.EncodingProfile) []string {
+	args := []string{"-c:v", p.Codec}
+	if p.Preset != "" {
+		switch p.Codec {
+		case "libvpx-vp9", "libaom-av1":
+			args = append(args, "-cpu-used", p.Preset)
+		default:
+			args = append(args, "-preset", p.Preset)
+		}
+	}
+	if p.CRF > 0 {
+		args = append(args, "-crf", fmt.Sprintf("%d", p.CRF))
+		if p.Codec == "libvpx-vp9" || p.Codec == "libaom-av1" {
+			// Required for constant quality mode.
+			args = append(args, "-b:v", "0")
+		}
+	} else if p.Bitrate != "" {
+		args = append(args, "-b:v", p.Bitrate)
+	}
+	if p.GOP > 0 {
+		args = append(args, "-g", fmt.Sprintf("%d", p.GOP))
+	}
+	if p.Threads > 0 {
+		args = append(args, "-threads", fmt.Sprintf("%d", p.Threads))
+	}
+	pixfmt := p.PixelFormat
+	if pixfmt == "" {
+		pixfmt = "yuv420p"
+	}
+	args = append(args, "-pix_fmt", pixfmt)
+	if p.Profile != "" {
+		args = append(args, "-profile:v", p.Profile)
+	}
+	if p.Level != "" {
+		args = append(args, "-level", p.Level)
+	}
+	return args
+}
+
+// ProbeEncodingProfile checks that the ffmpeg binary supports the profile by
+// encoding a few frames of a synthetic source.
+func ProbeEncodingProfile(ffmpeg string, p config.EncodingProfile) error {
+	if p.Codec == "" {
+		return fmt.Errorf("codec is required")
+	}
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-f", "lavfi", "-i", "testsrc=size=640x360:rate=15:duration=1",
+	}
+	if f := ScaleFilter(p); f != "" {
+		args = append(args, "-vf", f)
+	}
+	args = append(args, EncoderArgs(p)...)
+	args = append(args, "-f", "mp4", "-y", "/dev/null")
+
+	var stderr bytes.Buffer
+	c := exec.Command(ffmpeg, args...)
+	c.Stderr = &stderr
+	if err := c.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
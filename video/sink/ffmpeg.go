@@ -1,28 +1,53 @@
 package sink
 
 import (
+	"bufio"
 	"fmt"
-	log "github.com/sirupsen/logrus"
 	"image"
+	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	log "github.com/sirupsen/logrus"
+
+	"cam/config"
 	"cam/util"
 	"cam/video/source"
 )
 
 // TODO:
-// - get ffmpeg from path or env variable
 // - docs
-// - error handling (remove fatals)
 // - race where subprocess receives signal before the main program can react
-// (falls under error handling.)
-// - configuration options
 // - limit number of skipped frames allowed
 
 const (
 	ExtTemp = ".temp"
+
+	// maxRestarts limits how many times ffmpeg will be restarted for a single
+	// output file before giving up and dropping the remaining frames.
+	maxRestarts = 3
+)
+
+var (
+	ffmpegFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cam_ffmpeg_failures_total",
+		Help: "Number of ffmpeg encoder failures, by the stage which failed.",
+	}, []string{"stage"})
+
+	ffmpegRestarts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cam_ffmpeg_restarts_total",
+		Help: "Number of times ffmpeg was restarted into a new segment after a failure.",
+	})
+
+	ffmpegDroppedFrames = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "cam_ffmpeg_dropped_frames_total",
+		Help: "Number of frames not written to ffmpeg due to insufficient buffer or failure.",
+	})
 )
 
 type FFmpegOptions struct {
@@ -34,15 +59,60 @@ type FFmpegOptions struct {
 
 	// BufferTime is the amount of expected historical state to write.
 	BufferTime time.Duration
+
+	// Encoding defines the encoder settings for the output file.
+	Encoding config.EncodingProfile
 }
 
+// FFmpegSink encodes frames to an mp4 file using an ffmpeg subprocess. If
+// ffmpeg fails, it is restarted into a new segment and the segments are joined
+// when the sink is closed.
 type FFmpegSink struct {
 	Path  string
+	opts  FFmpegOptions
 	b     chan []byte
 	close chan chan bool
+	log   *log.Entry
+
+	// errs accumulates failures. Only accessed by the sink goroutine until
+	// Close returns.
+	errs []string
+
+	// partial is the segment currently being written.
+	partial string
+	l       sync.Mutex
+}
+
+// PartialPath returns the file currently being written, which is playable
+// since it is fragmented, or "" if ffmpeg is not running.
+func (f *FFmpegSink) PartialPath() string {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.partial
+}
+
+func (f *FFmpegSink) setPartial(path string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.partial = path
 }
 
-// TODO ffmpeg producer.
+// ffmpegSegment is a single ffmpeg process writing to a temporary file.
+type ffmpegSegment struct {
+	path       string
+	cmd        *exec.Cmd
+	pipe       io.WriteCloser
+	stderrDone chan bool
+	lastErr    string
+}
+
+// segmentPath is the temporary location of the nth segment.
+func (f *FFmpegSink) segmentPath(n int) string {
+	if n == 0 {
+		return f.Path + ExtTemp
+	}
+	return fmt.Sprintf("%s.%d%s", f.Path, n, ExtTemp)
+}
 
 func NewFFmpegSink(path string, opts FFmpegOptions) *FFmpegSink {
 	// Ensure we can store a reasonable buffer in memory without waiting for
@@ -52,86 +122,226 @@ func NewFFmpegSink(path string, opts FFmpegOptions) *FFmpegSink {
 
 	f := &FFmpegSink{
 		Path:  path,
+		opts:  opts,
 		b:     make(chan []byte, bufc),
 		close: make(chan chan bool),
+		log:   log.WithField("path", path),
 	}
-	go func() {
-
-		c := exec.Command(
-			util.LocateFFmpegOrDie(),
-			// Configure ffmpeg to read from the opencv pipe.
-			"-f", "rawvideo",
-			"-pixel_format", "bgr24",
-			"-video_size", fmt.Sprintf("%dx%d", opts.Size.X, opts.Size.Y),
-			"-framerate", fmt.Sprintf("%d", opts.FPS),
-			"-i", "-", // Read from stdin.
-			// Use h264 encoding with reasonable quality and speed. Note that
-			// "preset" can be adjusted if the system is too slow to handle encoding.
-			"-c:v", "libx264",
-			//"-preset", "superfast",
-			"-preset", "ultrafast",
-			"-crf", "30",
-			// Enable fast-start so videos can be displayed in the browser without
-			// full download.
-			"-movflags", "+faststart",
-			// Allow playback on a wider range of devices.
-			"-pix_fmt", "yuv420p",
-			"-profile:v", "baseline",
-			"-level", "3.0",
-			// Explicit format since our active output file will have a special extension.
-			"-f", "mp4",
-			path+ExtTemp,
-		)
-
-		var err error
-
-		// TODO convert some of this to structured logging.
-
-		// Allows for debugging ffmpeg in shell.
-		// TODO
-		c.Stdout = os.Stdout
-		c.Stderr = os.Stderr
-
-		pipe, err := c.StdinPipe()
-		if err != nil {
-			log.Fatalf("Error getting stdin %v", err)
-		}
+	go f.loop()
+	return f
+}
 
-		log.Infof("Start writing to '%s' using FFmpeg", path)
-		if err := c.Start(); err != nil {
-			log.Fatalf("Error starting ffmpeg %v", err)
-		}
+func (f *FFmpegSink) fail(stage string, err error) {
+	ffmpegFailures.WithLabelValues(stage).Inc()
+	f.log.WithField("stage", stage).Errorf("FFmpeg failure: %v", err)
+	f.errs = append(f.errs, fmt.Sprintf("%s: %v", stage, err))
+}
 
-		var closec chan bool
-	loop:
-		for {
-			select {
-			case closec = <-f.close:
-				log.Printf("Closing FFMPEG.")
-				if err := pipe.Close(); err != nil {
-					log.Fatalf("Failed to close pipe! %v", err)
-				}
-				break loop
-			case b := <-f.b:
-				if _, err := pipe.Write(b); err != nil {
-					// TODO error handling.
-					log.Fatalf("Error writing to pipe! (packet length %d)", len(b))
-				}
+func (f *FFmpegSink) loop() {
+	var done []string
+	var seg *ffmpegSegment
+	var closec chan bool
+	n := 0
+
+	f.log.Infof("Start writing using FFmpeg")
+loop:
+	for {
+		if seg == nil && n <= maxRestarts {
+			if n > 0 {
+				ffmpegRestarts.Inc()
+				f.log.Warnf("Restarting FFmpeg into segment %d", n)
+			}
+			var err error
+			seg, err = f.start(f.segmentPath(n))
+			if err != nil {
+				f.fail("start", err)
+			} else {
+				f.setPartial(seg.path)
+			}
+			n++
+		}
 
+		select {
+		case closec = <-f.close:
+			break loop
+		case b := <-f.b:
+			if seg == nil {
+				ffmpegDroppedFrames.Inc()
+				continue
+			}
+			if _, err := seg.pipe.Write(b); err != nil {
+				seg.abort()
+				f.fail("write", fmt.Errorf("%v (packet length %d) %s", err, len(b), seg.lastErr))
+				// Segments are fragmented, so everything up to the last
+				// complete fragment is still playable.
+				done = append(done, seg.path)
+				seg = nil
+				f.setPartial("")
 			}
 		}
+	}
+	f.setPartial("")
+
+	if seg != nil {
+		f.log.Infof("Waiting for FFmpeg shutdown...")
+		if err := seg.finish(); err != nil {
+			f.fail("exit", err)
+		}
+		done = append(done, seg.path)
+	}
+
+	if err := f.finalize(done); err != nil {
+		f.fail("finalize", err)
+	}
+	f.log.Infof("Finished writing (%d segments, %d errors)", len(done), len(f.errs))
+	closec <- true
+}
+
+func (f *FFmpegSink) start(path string) (*ffmpegSegment, error) {
+	args := rawInputArgs(f.opts.Size, f.opts.FPS)
+	args = append(args, encodeArgs(f.opts.Encoding)...)
+	args = append(args,
+		// Write fragmented mp4 so that the file is playable while still being
+		// written, and recoverable if ffmpeg dies. It is converted to a regular
+		// mp4 when finalized.
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-frag_duration", "1000000",
+		// Explicit format since our active output file will have a special extension.
+		"-f", "mp4",
+		"-y", path,
+	)
+	ffmpeg, err := util.LocateFFmpeg()
+	if err != nil {
+		return nil, err
+	}
+	s := &ffmpegSegment{
+		path:       path,
+		cmd:        exec.Command(ffmpeg, args...),
+		stderrDone: make(chan bool),
+	}
+
+	if s.pipe, err = s.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stderr, err := s.cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	go forwardLog(stderr, f.log.WithField("pid", s.cmd.Process.Pid), &s.lastErr, s.stderrDone)
+	return s, nil
+}
 
-		log.Printf("Waiting for FFmpeg shutdown...")
-		perr := c.Wait()
+// forwardLog copies ffmpeg output to the log, keeping the most recent line for
+// error reporting. done is closed once r reaches EOF.
+func forwardLog(r io.Reader, l *log.Entry, last *string, done chan bool) {
+	defer close(done)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		*last = scanner.Text()
+		l.Warnf("ffmpeg: %s", *last)
+	}
+}
 
-		log.Printf("Renaming from temp location")
-		if err := os.Rename(f.Path+ExtTemp, f.Path); err != nil {
-			log.Errorf("Error moving file to its final destination %v", err)
+// finish closes the input and waits for ffmpeg to write out the file.
+func (s *ffmpegSegment) finish() error {
+	s.pipe.Close()
+	<-s.stderrDone
+	if err := s.cmd.Wait(); err != nil {
+		return fmt.Errorf("%v %s", err, s.lastErr)
+	}
+	return nil
+}
+
+// abort kills ffmpeg, leaving behind whatever was written.
+func (s *ffmpegSegment) abort() {
+	s.pipe.Close()
+	s.cmd.Process.Kill()
+	<-s.stderrDone
+	s.cmd.Wait()
+}
+
+// readable checks whether ffmpeg is able to read a file. Damage after the
+// start, such as the incomplete last fragment left by a killed ffmpeg, is
+// tolerated since the rest is still usable.
+func readable(ffmpeg, path string) bool {
+	err := exec.Command(ffmpeg, "-v", "error", "-i", path, "-c", "copy", "-f", "null", "-").Run()
+	return err == nil
+}
+
+// finalize moves the completed segments to their final destination, joining
+// them together if ffmpeg had to be restarted. The fragmented output is
+// converted to a regular mp4 with fast-start.
+func (f *FFmpegSink) finalize(segments []string) error {
+	defer func() {
+		for _, s := range segments {
+			os.Remove(s)
 		}
-		log.Printf("Finished writing %s (error code %v)", path, perr)
-		closec <- true
 	}()
-	return f
+
+	ffmpeg, err := util.LocateFFmpeg()
+	if err != nil {
+		return err
+	}
+
+	valid := segments
+	if len(f.errs) > 0 {
+		// Something went wrong along the way, only keep segments that survived.
+		valid = nil
+		for _, s := range segments {
+			if readable(ffmpeg, s) {
+				valid = append(valid, s)
+			} else {
+				f.log.Warnf("Discarding unreadable segment %v", s)
+			}
+		}
+	}
+	if len(valid) == 0 {
+		return fmt.Errorf("no video written")
+	}
+
+	if err := concatFiles(ffmpeg, valid, f.Path); err != nil {
+		// Salvage what we can.
+		if rerr := os.Rename(valid[0], f.Path); rerr != nil {
+			return rerr
+		}
+		return fmt.Errorf("finalizing %d segments failed, kept first only: %v", len(valid), err)
+	}
+	return nil
+}
+
+// concatFiles joins video files with matching encoding parameters into a
+// single mp4 with fast-start, without re-encoding.
+func concatFiles(ffmpeg string, inputs []string, dst string) error {
+	list := dst + ".concat" + ExtTemp
+	joined := dst + ".joined" + ExtTemp
+	var sb strings.Builder
+	for _, s := range inputs {
+		fmt.Fprintf(&sb, "file '%s'\n", s)
+	}
+	if err := os.WriteFile(list, []byte(sb.String()), 0644); err != nil {
+		return err
+	}
+	defer os.Remove(list)
+
+	out, err := exec.Command(ffmpeg,
+		"-hide_banner", "-loglevel", "error",
+		"-f", "concat", "-safe", "0", "-i", list,
+		"-c", "copy",
+		// Enable fast-start so videos can be displayed in the browser without
+		// full download.
+		"-movflags", "+faststart",
+		"-f", "mp4",
+		"-y", joined,
+	).CombinedOutput()
+	if err != nil {
+		os.Remove(joined)
+		return fmt.Errorf("%v %s", err, strings.TrimSpace(string(out)))
+	}
+	return os.Rename(joined, dst)
 }
 
 func (f *FFmpegSink) Close() {
@@ -140,6 +350,15 @@ func (f *FFmpegSink) Close() {
 	<-c
 }
 
+// Err returns any failures that occurred while writing. Only valid after
+// Close has returned.
+func (f *FFmpegSink) Err() error {
+	if len(f.errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(f.errs, "; "))
+}
+
 func (f *FFmpegSink) Put(input source.Image) {
 	b := input.Mat.ToBytes()
 	// Without this copy here we seem to get random memory corruption? I'm not
@@ -152,6 +371,7 @@ func (f *FFmpegSink) Put(input source.Image) {
 	select {
 	case f.b <- c:
 	default:
-		log.Warningf("WARN: video output frame skip. Insufficient buffer?")
+		ffmpegDroppedFrames.Inc()
+		f.log.Warningf("WARN: video output frame skip. Insufficient buffer?")
 	}
 }
@@ -0,0 +1,364 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"cam/config"
+	"cam/video/source"
+)
+
+const (
+	// fmp4ClientBuffer is the number of fragments queued per client before it
+	// is considered lagging.
+	fmp4ClientBuffer = 8
+
+	// fmp4FragmentDuration limits fragment length (in microseconds) to keep
+	// latency low, independent of the keyframe interval.
+	fmp4FragmentDuration = 200000
+)
+
+type FMP4Options struct {
+	// Size is the dimensions of the source image.
+	Size image.Point
+
+	// FPS is the frame rate of the live stream.
+	FPS int
+
+	// Encoding defines the encoder settings for the stream.
+	Encoding config.EncodingProfile
+}
+
+// FMP4Fragment is a chunk of fragmented MP4 sent to clients. The first
+// fragment received by a client is always the initialization segment,
+// followed by media fragments starting with a keyframe.
+type FMP4Fragment struct {
+	Data     []byte
+	Init     bool
+	Keyframe bool
+
+	// MIME is the media type (including codecs) of the stream, only set for
+	// the initialization segment.
+	MIME string
+}
+
+// FMP4Client receives fragments of a live stream.
+type FMP4Client struct {
+	C chan *FMP4Fragment
+
+	// lagging is set when the client fails to keep up. Fragments are skipped
+	// until the next keyframe.
+	lagging bool
+}
+
+// FMP4Stream provides a live fragmented MP4 stream suitable for Media Source
+// Extensions. Images are only encoded while clients are subscribed.
+type FMP4Stream struct {
+	opts FMP4Options
+	log  *log.Entry
+
+	// Only accessed from Put.
+	enc *liveEncoder
+
+	clients map[*FMP4Client]bool
+	init    *FMP4Fragment
+	l       sync.Mutex
+}
+
+func NewFMP4Stream(opts FMP4Options) *FMP4Stream {
+	l := log.WithField("stream", "fmp4")
+	return &FMP4Stream{
+		opts:    opts,
+		log:     l,
+		enc:     &liveEncoder{log: l, fps: opts.FPS},
+		clients: make(map[*FMP4Client]bool),
+	}
+}
+
+// Subscribe registers a new client. The caller must Unsubscribe when done.
+func (s *FMP4Stream) Subscribe() *FMP4Client {
+	c := &FMP4Client{
+		C:       make(chan *FMP4Fragment, fmp4ClientBuffer),
+		lagging: true, // Wait for a keyframe.
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.init != nil {
+		c.C <- s.init
+	}
+	s.clients[c] = true
+	return c
+}
+
+func (s *FMP4Stream) Unsubscribe(c *FMP4Client) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	delete(s.clients, c)
+}
+
+func (s *FMP4Stream) active() bool {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return len(s.clients) > 0
+}
+
+// Put encodes the image if there are clients subscribed. Must be called from
+// a single goroutine.
+func (s *FMP4Stream) Put(input source.Image) {
+	if !s.active() {
+		if s.enc.running() {
+			s.log.Infof("No fMP4 clients, stopping encoder")
+			s.enc.stop()
+		}
+		return
+	}
+	// An encoder which exited, e.g. because its output could not be parsed,
+	// is restarted; clients then receive the new initialization segment.
+	if !s.enc.running() {
+		if !s.enc.ready() {
+			return
+		}
+		if err := s.start(); err != nil {
+			s.log.Errorf("Failed to start fMP4 encoder: %v", err)
+			s.enc.failed()
+			return
+		}
+	}
+	s.enc.Put(input)
+}
+
+func (s *FMP4Stream) start() error {
+	args := rawInputArgs(s.opts.Size, s.opts.FPS)
+	args = append(args, encodeArgs(s.opts.Encoding)...)
+	args = append(args,
+		"-f", "mp4",
+		"-movflags", "frag_keyframe+empty_moov+default_base_moof",
+		"-frag_duration", fmt.Sprintf("%d", fmp4FragmentDuration),
+		"pipe:1",
+	)
+	pr, pw := io.Pipe()
+	e, err := newPipeEncoder(s.log, args, pw)
+	if err != nil {
+		return err
+	}
+	readerDone := make(chan bool)
+	go func() {
+		defer close(readerDone)
+		if err := s.readFragments(pr); err != nil && err != io.EOF {
+			// Closing the pipe makes ffmpeg exit, so the encoder is restarted.
+			s.log.Errorf("Failed to read fMP4 stream: %v", err)
+		}
+		pr.Close()
+	}()
+	s.log.Infof("Started fMP4 encoder")
+	s.enc.start(e, func() {
+		pw.Close()
+		<-readerDone
+		s.l.Lock()
+		s.init = nil
+		s.l.Unlock()
+	})
+	return nil
+}
+
+// Close stops the encoder. Must not be called concurrently with Put.
+func (s *FMP4Stream) Close() {
+	s.enc.Close()
+}
+
+type mp4Box struct {
+	typ  string
+	data []byte // Including header.
+}
+
+// readBox reads a single top-level box.
+func readBox(r io.Reader) (*mp4Box, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	size := uint64(binary.BigEndian.Uint32(hdr))
+	typ := string(hdr[4:8])
+	if size == 1 {
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, ext...)
+		size = binary.BigEndian.Uint64(ext)
+	}
+	if size < uint64(len(hdr)) || size > 1<<30 {
+		return nil, fmt.Errorf("invalid size %d for box %q", size, typ)
+	}
+	data := make([]byte, size)
+	copy(data, hdr)
+	if _, err := io.ReadFull(r, data[len(hdr):]); err != nil {
+		return nil, err
+	}
+	return &mp4Box{typ: typ, data: data}, nil
+}
+
+// readFragments splits the ffmpeg output into the initialization segment
+// (ftyp+moov) and media fragments (moof+mdat), broadcasting them to clients.
+func (s *FMP4Stream) readFragments(r io.Reader) error {
+	br := bufio.NewReader(r)
+	var pending []byte
+	var keyframe bool
+	for {
+		box, err := readBox(br)
+		if err != nil {
+			return err
+		}
+		switch box.typ {
+		case "ftyp":
+			pending = box.data
+		case "moov":
+			init := &FMP4Fragment{Data: append(pending, box.data...), Init: true}
+			init.MIME = mimeFromInit(init.Data)
+			pending = nil
+			s.setInit(init)
+		case "moof":
+			pending = box.data
+			keyframe = moofStartsWithKeyframe(box.data)
+		case "mdat":
+			s.broadcast(&FMP4Fragment{Data: append(pending, box.data...), Keyframe: keyframe})
+			pending = nil
+		}
+	}
+}
+
+func (s *FMP4Stream) setInit(init *FMP4Fragment) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.init = init
+	for c := range s.clients {
+		// Anything still queued belongs to the previous stream, and the client
+		// can't decode what follows without the new initialization segment.
+		for drained := false; !drained; {
+			select {
+			case <-c.C:
+			default:
+				drained = true
+			}
+		}
+		c.C <- init
+		c.lagging = true
+	}
+}
+
+func (s *FMP4Stream) broadcast(f *FMP4Fragment) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	for c := range s.clients {
+		if c.lagging && !f.Keyframe {
+			continue
+		}
+		select {
+		case c.C <- f:
+			c.lagging = false
+		default:
+			// Client can't keep up; skip ahead to the next keyframe.
+			c.lagging = true
+		}
+	}
+}
+
+// childBoxes iterates over the boxes contained in data, which excludes the
+// parent header.
+func childBoxes(data []byte, f func(typ string, body []byte)) {
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			return
+		}
+		f(string(data[4:8]), data[8:size])
+		data = data[size:]
+	}
+}
+
+// sampleIsSync interprets ISO BMFF sample flags.
+func sampleIsSync(flags uint32) bool {
+	return flags&0x10000 == 0 // sample_is_non_sync_sample
+}
+
+// moofStartsWithKeyframe checks whether the first sample of a movie fragment
+// is a sync sample. Returns true if this can't be determined.
+func moofStartsWithKeyframe(moof []byte) bool {
+	result := true
+	childBoxes(moof[8:], func(typ string, traf []byte) {
+		if typ != "traf" {
+			return
+		}
+		var defaultFlags *uint32
+		childBoxes(traf, func(typ string, body []byte) {
+			if len(body) < 8 {
+				return
+			}
+			flags := binary.BigEndian.Uint32(body) & 0xffffff
+			switch typ {
+			case "tfhd":
+				// track_ID, then optional fields in order.
+				off := 8
+				for _, f := range []struct {
+					bit  uint32
+					size int
+				}{{0x1, 8}, {0x2, 4}, {0x8, 4}, {0x10, 4}} {
+					if flags&f.bit != 0 {
+						off += f.size
+					}
+				}
+				if flags&0x20 != 0 && len(body) >= off+4 {
+					v := binary.BigEndian.Uint32(body[off:])
+					defaultFlags = &v
+				}
+			case "trun":
+				off := 8 // version/flags, sample_count
+				if flags&0x1 != 0 {
+					off += 4 // data_offset
+				}
+				if flags&0x4 != 0 && len(body) >= off+4 {
+					result = sampleIsSync(binary.BigEndian.Uint32(body[off:]))
+					return
+				}
+				if flags&0x400 != 0 {
+					// Per-sample flags follow duration and size if present.
+					if flags&0x100 != 0 {
+						off += 4
+					}
+					if flags&0x200 != 0 {
+						off += 4
+					}
+					if len(body) >= off+4 {
+						result = sampleIsSync(binary.BigEndian.Uint32(body[off:]))
+						return
+					}
+				}
+				if defaultFlags != nil {
+					result = sampleIsSync(*defaultFlags)
+				}
+			}
+		})
+	})
+	return result
+}
+
+// mimeFromInit builds the media type for Media Source Extensions from the
+// avcC box of an initialization segment. Returns a generic type for other
+// codecs.
+func mimeFromInit(init []byte) string {
+	i := bytes.Index(init, []byte("avcC"))
+	if i < 0 || len(init) < i+8 {
+		return "video/mp4"
+	}
+	// configurationVersion, AVCProfileIndication, profile_compatibility,
+	// AVCLevelIndication.
+	c := init[i+4:]
+	return fmt.Sprintf(`video/mp4; codecs="avc1.%02x%02x%02x"`, c[1], c[2], c[3])
+}
@@ -0,0 +1,153 @@
+package sink
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// box builds an ISO BMFF box from its type and body parts.
+func box(typ string, parts ...[]byte) []byte {
+	var body []byte
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], typ)
+	return append(b, body...)
+}
+
+func u32(vs ...uint32) []byte {
+	b := make([]byte, 4*len(vs))
+	for i, v := range vs {
+		binary.BigEndian.PutUint32(b[4*i:], v)
+	}
+	return b
+}
+
+const (
+	syncFlags    = 0x02000000 // sample_depends_on = 2
+	nonSyncFlags = 0x01010000 // sample_depends_on = 1, sample_is_non_sync_sample
+)
+
+func TestMoofStartsWithKeyframe(t *testing.T) {
+	tfhd := func(flags uint32, fields ...uint32) []byte {
+		return box("tfhd", u32(flags, 1), u32(fields...))
+	}
+	for _, tc := range []struct {
+		name string
+		moof []byte
+		want bool
+	}{
+		{
+			name: "first sample flags, sync",
+			moof: box("moof", box("mfhd", u32(0, 1)), box("traf",
+				tfhd(0),
+				box("trun", u32(0x1|0x4, 30, 100, syncFlags)))),
+			want: true,
+		},
+		{
+			name: "first sample flags, not sync",
+			moof: box("moof", box("traf",
+				tfhd(0),
+				box("trun", u32(0x1|0x4, 30, 100, nonSyncFlags)))),
+			want: false,
+		},
+		{
+			name: "per-sample flags after duration and size",
+			moof: box("moof", box("traf",
+				tfhd(0),
+				box("trun", u32(0x1|0x100|0x200|0x400, 2, 100, 33, 5000, nonSyncFlags, 33, 400, nonSyncFlags)))),
+			want: false,
+		},
+		{
+			name: "per-sample flags only",
+			moof: box("moof", box("traf",
+				tfhd(0),
+				box("trun", u32(0x400, 1, syncFlags)))),
+			want: true,
+		},
+		{
+			name: "default flags after base data offset",
+			moof: box("moof", box("traf",
+				tfhd(0x1|0x20, 0, 4096, nonSyncFlags),
+				box("trun", u32(0x1, 30, 100)))),
+			want: false,
+		},
+		{
+			name: "default flags after description index and duration",
+			moof: box("moof", box("traf",
+				tfhd(0x2|0x8|0x20, 1, 33, syncFlags),
+				box("trun", u32(0, 30)))),
+			want: true,
+		},
+		{
+			name: "no flags",
+			moof: box("moof", box("traf", tfhd(0), box("trun", u32(0, 30)))),
+			want: true,
+		},
+		{
+			name: "no track fragment",
+			moof: box("moof", box("mfhd", u32(0, 1))),
+			want: true,
+		},
+	} {
+		if got := moofStartsWithKeyframe(tc.moof); got != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMimeFromInit(t *testing.T) {
+	avcC := box("avcC", []byte{1, 0x64, 0x00, 0x1f, 0xff})
+	for _, tc := range []struct {
+		name string
+		init []byte
+		want string
+	}{
+		{
+			name: "h264",
+			init: append(box("ftyp", []byte("isom")), box("moov", box("trak", box("stsd", box("avc1", avcC))))...),
+			want: `video/mp4; codecs="avc1.64001f"`,
+		},
+		{
+			name: "other codec",
+			init: append(box("ftyp", []byte("isom")), box("moov", box("trak", box("stsd", box("hvc1", box("hvcC", []byte{1, 2, 3, 4})))))...),
+			want: "video/mp4",
+		},
+		{
+			name: "truncated",
+			init: []byte("....avcC\x01\x64"),
+			want: "video/mp4",
+		},
+	} {
+		if got := mimeFromInit(tc.init); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSetInitReplacesQueued(t *testing.T) {
+	s := NewFMP4Stream(FMP4Options{})
+	c := s.Subscribe()
+	defer s.Unsubscribe(c)
+	s.setInit(&FMP4Fragment{Init: true, MIME: "old"})
+	for i := 0; i < fmp4ClientBuffer; i++ {
+		s.broadcast(&FMP4Fragment{Keyframe: true})
+	}
+
+	// The encoder restarted while the client's buffer was full.
+	s.setInit(&FMP4Fragment{Init: true, MIME: "new"})
+	s.broadcast(&FMP4Fragment{Keyframe: false})
+	s.broadcast(&FMP4Fragment{Keyframe: true})
+
+	if f := <-c.C; !f.Init || f.MIME != "new" {
+		t.Fatalf("got %+v, want the new initialization segment", f)
+	}
+	if f := <-c.C; !f.Keyframe {
+		t.Errorf("got %+v after the initialization segment, want a keyframe", f)
+	}
+	if n := len(c.C); n != 0 {
+		t.Errorf("%d fragments left queued, want none", n)
+	}
+}
@@ -0,0 +1,191 @@
+package sink
+
+import (
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cam/config"
+	"cam/video/source"
+)
+
+const (
+	hlsPlaylist = "live.m3u8"
+
+	// hlsPlaylistWait bounds how long a new viewer waits for the encoder to
+	// produce the first segment.
+	hlsPlaylistWait = 15 * time.Second
+)
+
+type HLSOptions struct {
+	// Size is the dimensions of the source image.
+	Size image.Point
+
+	// FPS is the frame rate of the live stream.
+	FPS int
+
+	// Encoding defines the encoder settings for the stream.
+	Encoding config.EncodingProfile
+
+	// SegmentTime is the target duration of each segment.
+	SegmentTime time.Duration
+
+	// ListSize is the number of segments kept in the playlist.
+	ListSize int
+
+	// IdleTimeout stops the encoder once no viewer has made a request for
+	// this long.
+	IdleTimeout time.Duration
+}
+
+// HLSServer provides a live HLS stream. Images are only encoded while viewers
+// are connected; the encoder is started by the first request and stopped
+// after IdleTimeout.
+type HLSServer struct {
+	opts HLSOptions
+	dir  string
+	log  *log.Entry
+
+	// Only accessed from Put.
+	enc *liveEncoder
+
+	lastRequest time.Time
+	l           sync.Mutex
+}
+
+func NewHLSServer(opts HLSOptions) (*HLSServer, error) {
+	dir, err := os.MkdirTemp("", "cam-hls")
+	if err != nil {
+		return nil, err
+	}
+	l := log.WithField("hls", dir)
+	return &HLSServer{
+		opts: opts,
+		dir:  dir,
+		log:  l,
+		enc:  &liveEncoder{log: l, fps: opts.FPS},
+	}, nil
+}
+
+func (h *HLSServer) idle() bool {
+	h.l.Lock()
+	defer h.l.Unlock()
+	return time.Since(h.lastRequest) > h.opts.IdleTimeout
+}
+
+// Put encodes the image if there are active viewers. Must be called from a
+// single goroutine.
+func (h *HLSServer) Put(input source.Image) {
+	if h.idle() {
+		if h.enc.running() {
+			h.log.Infof("No HLS viewers, stopping encoder")
+			h.enc.stop()
+		}
+		return
+	}
+	if !h.enc.running() {
+		if !h.enc.ready() {
+			return
+		}
+		if err := h.start(); err != nil {
+			h.log.Errorf("Failed to start HLS encoder: %v", err)
+			h.enc.failed()
+			return
+		}
+	}
+	h.enc.Put(input)
+}
+
+func (h *HLSServer) clear() {
+	entries, _ := os.ReadDir(h.dir)
+	for _, e := range entries {
+		os.Remove(filepath.Join(h.dir, e.Name()))
+	}
+}
+
+func (h *HLSServer) start() error {
+	h.clear()
+	args := rawInputArgs(h.opts.Size, h.opts.FPS)
+	args = append(args, encodeArgs(h.opts.Encoding)...)
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", fmt.Sprintf("%.3f", h.opts.SegmentTime.Seconds()),
+		"-hls_list_size", fmt.Sprintf("%d", h.opts.ListSize),
+		// Write the playlist and segments to temporary files and rename them,
+		// so that clients never read them partially written.
+		"-hls_flags", "delete_segments+independent_segments+temp_file",
+		"-hls_segment_filename", filepath.Join(h.dir, "seg%05d.ts"),
+		filepath.Join(h.dir, hlsPlaylist),
+	)
+	e, err := newPipeEncoder(h.log, args, nil)
+	if err != nil {
+		return err
+	}
+	h.log.Infof("Started HLS encoder")
+	h.enc.start(e, h.clear)
+	return nil
+}
+
+// Close stops the encoder and removes all segments. Must not be called
+// concurrently with Put.
+func (h *HLSServer) Close() {
+	h.enc.Close()
+	os.RemoveAll(h.dir)
+}
+
+// ServeHTTP implements http.Handler interface, serving the playlist and
+// segments. It should be mounted with http.StripPrefix so that the request path
+// is the file name.
+func (h *HLSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	if name == "/" || name == "." {
+		name = hlsPlaylist
+	}
+
+	var contentType string
+	switch path.Ext(name) {
+	case ".m3u8":
+		contentType = "application/vnd.apple.mpegurl"
+	case ".ts":
+		contentType = "video/mp2t"
+	default:
+		http.Error(w, "unknown file type", http.StatusNotFound)
+		return
+	}
+
+	h.l.Lock()
+	h.lastRequest = time.Now()
+	h.l.Unlock()
+
+	p := filepath.Join(h.dir, name)
+	f, err := os.Open(p)
+	if os.IsNotExist(err) && name == hlsPlaylist {
+		// The encoder starts lazily; wait for the first segment.
+		deadline := time.Now().Add(hlsPlaylistWait)
+		for os.IsNotExist(err) && time.Now().Before(deadline) && r.Context().Err() == nil {
+			time.Sleep(250 * time.Millisecond)
+			h.l.Lock()
+			h.lastRequest = time.Now()
+			h.l.Unlock()
+			f, err = os.Open(p)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", contentType)
+	if contentType == "application/vnd.apple.mpegurl" {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, time.Time{}, f)
+}
@@ -1,14 +1,20 @@
 package sink
 
 import (
+	"bytes"
 	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	log "github.com/sirupsen/logrus"
 	"gocv.io/x/gocv"
 	"image"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
+
+	"cam/config"
 )
 
 // MJPEG multi-streaming, based on implementation by saljam:
@@ -22,6 +28,36 @@ const headerf = "\r\n" +
 	"X-Timestamp: 0.000000\r\n" +
 	"\r\n"
 
+// singleFrameTimeout bounds how long a single frame request waits for the
+// stream to produce an image. Debug streams only produce images while their
+// stage is running.
+const singleFrameTimeout = 10 * time.Second
+
+const (
+	// mjpegDefaultQuality matches the OpenCV default, used when the client
+	// doesn't request a quality.
+	mjpegDefaultQuality = 95
+
+	// Adaptive quality: each skipped frame lowers quality by a step, down to
+	// mjpegMinQuality. A streak of delivered frames raises it by a step.
+	mjpegMinQuality    = 30
+	mjpegQualityStep   = 10
+	mjpegQualityStreak = 30
+)
+
+var (
+	mjpegEncodeSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "cam_mjpeg_encode_seconds",
+		Help:    "Time taken to encode a JPEG for an MJPEG stream, per client setting.",
+		Buckets: prometheus.ExponentialBuckets(0.001, 2, 10),
+	}, []string{"stream"})
+
+	mjpegSkippedFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "cam_mjpeg_skipped_frames_total",
+		Help: "Number of MJPEG frames skipped, because a newer image superseded it before encoding or a client was not ready.",
+	}, []string{"stream", "reason"})
+)
+
 type MJPEGID struct {
 	// TODO include camera
 	Name string
@@ -33,7 +69,59 @@ type MJPEGClientState struct {
 	FPS     float64
 	Quality int
 
+	// Crop selects a region of the image, which is then scaled to Width and
+	// Height if set.
+	Crop config.Crop
+
 	lastSent time.Time
+
+	// quality is the current JPEG quality, lowered while the client can't keep
+	// up and raised again once it does. Zero until first used.
+	quality int
+	streak  int
+}
+
+func (cl *MJPEGClientState) targetQuality() int {
+	if cl.Quality == 0 {
+		return mjpegDefaultQuality
+	}
+	return cl.Quality
+}
+
+func (cl *MJPEGClientState) effectiveQuality() int {
+	if cl.quality == 0 {
+		return cl.targetQuality()
+	}
+	return cl.quality
+}
+
+// sent records a frame delivered to the client, restoring quality after a run
+// of successful sends.
+func (cl *MJPEGClientState) sent() {
+	cl.streak++
+	if cl.streak < mjpegQualityStreak {
+		return
+	}
+	cl.streak = 0
+	if q := cl.effectiveQuality() + mjpegQualityStep; q < cl.targetQuality() {
+		cl.quality = q
+	} else {
+		cl.quality = cl.targetQuality()
+	}
+}
+
+// skipped records a frame the client was too slow to receive, lowering its
+// quality to reduce the data sent.
+func (cl *MJPEGClientState) skipped() {
+	cl.streak = 0
+	q := cl.effectiveQuality() - mjpegQualityStep
+	if q < mjpegMinQuality {
+		q = mjpegMinQuality
+	}
+	if target := cl.targetQuality(); q > target {
+		q = target
+	}
+	cl.quality = q
 }
 
 func (cl *MJPEGClientState) ready() bool {
@@ -51,7 +139,8 @@ func (cl *MJPEGClientState) key() MJPEGClientState {
 	return MJPEGClientState{
 		Width:   cl.Width,
 		Height:  cl.Height,
-		Quality: cl.Quality,
+		Quality: cl.effectiveQuality(),
+		Crop:    cl.Crop,
 	}
 }
 
@@ -80,12 +169,52 @@ func (s *MJPEGServer) NewStream(id MJPEGID) *MJPEGStream {
 		m:      make(map[chan []byte]*MJPEGClientState),
 		frame:  make([]byte, len(headerf)),
 		parent: s,
+
+		pending: gocv.NewMat(),
+		working: gocv.NewMat(),
+		wake:    make(chan bool, 1),
+		close:   make(chan bool),
+		done:    make(chan bool),
 	}
+	go ms.worker()
 
 	s.m[id] = ms
 	return ms
 }
 
+// MJPEGStreamInfo describes a registered stream.
+type MJPEGStreamInfo struct {
+	MJPEGID
+
+	// Width and Height of the most recent input image, zero if none yet.
+	Width  int
+	Height int
+
+	// FPS is the measured input frame rate.
+	FPS float64
+
+	Clients int
+}
+
+// Streams lists all registered streams, sorted by name.
+func (s *MJPEGServer) Streams() []MJPEGStreamInfo {
+	s.lock.Lock()
+	streams := make([]*MJPEGStream, 0, len(s.m))
+	for _, ms := range s.m {
+		streams = append(streams, ms)
+	}
+	s.lock.Unlock()
+
+	infos := make([]MJPEGStreamInfo, 0, len(streams))
+	for _, ms := range streams {
+		infos = append(infos, ms.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
 func (s *MJPEGServer) getStream(id MJPEGID) *MJPEGStream {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -95,6 +224,20 @@ func (s *MJPEGServer) getStream(id MJPEGID) *MJPEGStream {
 	return nil
 }
 
+// ServeSnapshot serves a single JPEG from a stream, accepting the same
+// parameters as ServeHTTP. The stream defaults to "default".
+func (s *MJPEGServer) ServeSnapshot(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Form.Get("name") == "" {
+		r.Form.Set("name", "default")
+	}
+	r.Form.Set("single", "1")
+	s.ServeHTTP(w, r)
+}
+
 // ServeHTTP implements http.Handler interface, serving MJPEG.
 func (s *MJPEGServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if err := r.ParseForm(); err != nil {
@@ -117,8 +260,6 @@ func (s *MJPEGServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Add("Content-Type", "multipart/x-mixed-replace;boundary="+boundaryWord)
-
 	cs := &MJPEGClientState{}
 
 	if s := r.Form.Get("width"); s != "" {
@@ -157,6 +298,22 @@ func (s *MJPEGServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if s := r.Form.Get("crop"); s != "" {
+		if v, err := config.ParseCrop(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else {
+			cs.Crop = v
+		}
+	}
+
+	if r.Form.Get("single") == "1" {
+		stream.serveSingle(w, r, cs)
+		return
+	}
+
+	w.Header().Add("Content-Type", "multipart/x-mixed-replace;boundary="+boundaryWord)
+
 	log.WithField("addr", r.RemoteAddr).Infof("MJPEG stream connected to %v for %q with config %#v", id, id.Name, cs)
 
 	c := make(chan []byte)
@@ -178,15 +335,94 @@ func (s *MJPEGServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.WithField("addr", r.RemoteAddr).Infof("MJPEG stream disconnected from %v", id)
 }
 
+// serveSingle responds with the next frame of the stream as a single JPEG.
+func (s *MJPEGStream) serveSingle(w http.ResponseWriter, r *http.Request, cs *MJPEGClientState) {
+	c := make(chan []byte)
+	s.lock.Lock()
+	s.m[c] = cs
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.m, c)
+		s.lock.Unlock()
+	}()
+
+	var b []byte
+	select {
+	case b = <-c:
+	case <-time.After(singleFrameTimeout):
+		http.Error(w, "no frame available", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	// Strip the multipart header.
+	if i := bytes.Index(b, []byte("\r\n\r\n")); i >= 0 {
+		b = b[i+4:]
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(b)
+}
+
 type MJPEGStream struct {
 	id    MJPEGID
 	m     map[chan []byte]*MJPEGClientState
 	frame []byte
 
+	// pending is the latest image waiting to be encoded, swapped with working
+	// by the worker.
+	pending, working gocv.Mat
+	hasPending       bool
+	wake             chan bool
+	close            chan bool
+	done             chan bool
+
+	// Input statistics, for the stream directory.
+	size        image.Point
+	fps         float64
+	frames      int
+	framesSince time.Time
+
 	parent *MJPEGServer
 	lock   sync.Mutex
 }
 
+// countFrame updates the input statistics.
+func (s *MJPEGStream) countFrame(input gocv.Mat) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.size = image.Point{X: input.Cols(), Y: input.Rows()}
+
+	now := time.Now()
+	if s.framesSince.IsZero() {
+		s.framesSince = now
+	}
+	s.frames++
+	if d := now.Sub(s.framesSince); d >= time.Second {
+		s.fps = float64(s.frames) / d.Seconds()
+		s.frames = 0
+		s.framesSince = now
+	}
+}
+
+func (s *MJPEGStream) info() MJPEGStreamInfo {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	fps := s.fps
+	if time.Since(s.framesSince) > 2*time.Second {
+		fps = 0 // Stream has stalled.
+	}
+	return MJPEGStreamInfo{
+		MJPEGID: s.id,
+		Width:   s.size.X,
+		Height:  s.size.Y,
+		FPS:     fps,
+		Clients: len(s.m),
+	}
+}
+
 func (s *MJPEGStream) empty() bool {
 	s.lock.Lock()
 	defer s.lock.Unlock()
@@ -203,12 +439,62 @@ func (s *MJPEGStream) empty() bool {
 	return true
 }
 
+// Active returns whether any client is ready for a new frame, which can be used
+// to skip preparing images nobody will see.
+func (s *MJPEGStream) Active() bool {
+	return !s.empty()
+}
+
+// Put queues the image for encoding. Encoding happens on the stream's own
+// worker so slow clients don't hold up the caller; if the worker is still busy
+// with a previous image when the next one arrives, the older one is skipped.
 func (s *MJPEGStream) Put(input gocv.Mat) {
+	s.countFrame(input)
 	if s.empty() {
 		// Nobody is listening; don't bother encoding.
 		return
 	}
 
+	s.lock.Lock()
+	if s.hasPending {
+		mjpegSkippedFrames.WithLabelValues(s.id.Name, "superseded").Inc()
+	}
+	input.CopyTo(&s.pending)
+	s.hasPending = true
+	s.lock.Unlock()
+
+	select {
+	case s.wake <- true:
+	default:
+		// Worker already signalled.
+	}
+}
+
+func (s *MJPEGStream) worker() {
+	defer close(s.done)
+	for {
+		select {
+		case <-s.wake:
+		case <-s.close:
+			return
+		}
+
+		s.lock.Lock()
+		if !s.hasPending {
+			s.lock.Unlock()
+			continue
+		}
+		s.pending, s.working = s.working, s.pending
+		s.hasPending = false
+		s.lock.Unlock()
+
+		s.encode(s.working)
+	}
+}
+
+// encode converts the image to JPEG once for every distinct client setting,
+// and sends the result to clients ready for a new frame.
+func (s *MJPEGStream) encode(input gocv.Mat) {
 	// Idenitfy all the resolutions we need to encode for connected clients.
 	resolutions := make(map[MJPEGClientState][]byte)
 	s.lock.Lock()
@@ -220,28 +506,31 @@ func (s *MJPEGStream) Put(input gocv.Mat) {
 	}
 	s.lock.Unlock()
 
+	small := gocv.NewMat()
+	defer small.Close()
+
 	// Generate all resolutions and qualities we need
-	for res, _ := range resolutions {
+	for res := range resolutions {
+		start := time.Now()
 		var convert gocv.Mat
 		convert = input
 
-		small := gocv.NewMat()
-		defer small.Close()
+		var region *gocv.Mat
+		if !res.Crop.IsZero() {
+			m := input.Region(res.Crop.Rect(image.Point{X: input.Cols(), Y: input.Rows()}))
+			region = &m
+			convert = m
+		}
 
 		if res.Width != 0 || res.Height != 0 {
-			gocv.Resize(input, &small, image.Point{X: res.Width, Y: res.Height}, 0, 0, gocv.InterpolationDefault)
+			gocv.Resize(convert, &small, image.Point{X: res.Width, Y: res.Height}, 0, 0, gocv.InterpolationDefault)
 			convert = small
 		}
 
-		var jpeg *gocv.NativeByteBuffer
-		var err error
-
-		if res.Quality == 0 {
-			jpeg, err = gocv.IMEncode(".jpg", convert)
-		} else {
-			jpeg, err = gocv.IMEncodeWithParams(".jpg", convert, []int{gocv.IMWriteJpegQuality, res.Quality})
+		jpeg, err := gocv.IMEncodeWithParams(".jpg", convert, []int{gocv.IMWriteJpegQuality, res.Quality})
+		if region != nil {
+			region.Close()
 		}
-
 		if err != nil {
 			log.Errorf("Error encoding to JPG for MJPEG stream %v: %v", s.id, err)
 			return
@@ -254,9 +543,11 @@ func (s *MJPEGStream) Put(input gocv.Mat) {
 		b := make([]byte, l)
 		copy(b, header)
 		copy(b[len(header):], jpeg.GetBytes())
+		jpeg.Close()
 
 		// Save final result
 		resolutions[res] = b
+		mjpegEncodeSeconds.WithLabelValues(s.id.Name).Observe(time.Since(start).Seconds())
 	}
 
 	// Stream converted image to all clients
@@ -276,16 +567,25 @@ func (s *MJPEGStream) Put(input gocv.Mat) {
 		select {
 		case c <- b:
 			cl.lastSent = time.Now()
+			cl.sent()
 		default:
 			// Skip listeners not ready for next frame.
+			mjpegSkippedFrames.WithLabelValues(s.id.Name, "client").Inc()
+			cl.skipped()
 		}
 	}
 }
 
+// Close unregisters the stream and stops its worker.
 func (s *MJPEGStream) Close() {
 	s.parent.lock.Lock()
-	defer s.parent.lock.Unlock()
 	delete(s.parent.m, s.id)
+	s.parent.lock.Unlock()
+
+	close(s.close)
+	<-s.done
+	s.pending.Close()
+	s.working.Close()
 }
 
 // MJPEGStreamPool is a convenience wrapper that holds a number of streams that
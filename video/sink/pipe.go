@@ -0,0 +1,242 @@
+package sink
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os/exec"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cam/config"
+	"cam/util"
+	"cam/video/source"
+)
+
+const (
+	// pipeCloseTimeout is how long to wait for ffmpeg to exit after its input
+	// is closed before killing it.
+	pipeCloseTimeout = 5 * time.Second
+
+	// liveRetryDelay throttles restarts of live encoders after a failure.
+	liveRetryDelay = 5 * time.Second
+)
+
+// pipeEncoder is a Sink which feeds raw frames to a long-running ffmpeg
+// process. Unlike FFmpegSink, it makes no attempt to recover from failures;
+// it is intended for live outputs which can simply be restarted.
+type pipeEncoder struct {
+	cmd  *exec.Cmd
+	pipe io.WriteCloser
+	b    chan []byte
+	log  *log.Entry
+
+	stderrDone chan bool
+	writerDone chan bool
+	lastErr    string
+
+	// exited is closed once ffmpeg has exited, after which waitErr is set.
+	exited  chan bool
+	waitErr error
+}
+
+// rawInputArgs configures ffmpeg to read frames written by a pipeEncoder.
+func rawInputArgs(size image.Point, fps int) []string {
+	return []string{
+		"-hide_banner", "-nostats", "-loglevel", "warning",
+		// Configure ffmpeg to read from the opencv pipe.
+		"-f", "rawvideo",
+		"-pixel_format", "bgr24",
+		"-video_size", fmt.Sprintf("%dx%d", size.X, size.Y),
+		"-framerate", fmt.Sprintf("%d", fps),
+		"-i", "-", // Read from stdin.
+	}
+}
+
+// encodeArgs returns the output arguments for an encoding profile, including
+// scaling.
+func encodeArgs(p config.EncodingProfile) []string {
+	var args []string
+	if vf := ScaleFilter(p); vf != "" {
+		args = append(args, "-vf", vf)
+	}
+	return append(args, EncoderArgs(p)...)
+}
+
+// newPipeEncoder starts ffmpeg with the provided arguments. If stdout is set,
+// it receives the ffmpeg output stream.
+func newPipeEncoder(l *log.Entry, args []string, stdout io.Writer) (*pipeEncoder, error) {
+	ffmpeg, err := util.LocateFFmpeg()
+	if err != nil {
+		return nil, err
+	}
+	e := &pipeEncoder{
+		cmd:        exec.Command(ffmpeg, args...),
+		b:          make(chan []byte, 10),
+		log:        l,
+		stderrDone: make(chan bool),
+		writerDone: make(chan bool),
+		exited:     make(chan bool),
+	}
+	e.cmd.Stdout = stdout
+	if e.pipe, err = e.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	stderr, err := e.cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := e.cmd.Start(); err != nil {
+		return nil, err
+	}
+	go forwardLog(stderr, l.WithField("pid", e.cmd.Process.Pid), &e.lastErr, e.stderrDone)
+	go func() {
+		// Wait must not be called before all of stderr has been read.
+		<-e.stderrDone
+		e.waitErr = e.cmd.Wait()
+		close(e.exited)
+	}()
+	go func() {
+		defer close(e.writerDone)
+		for b := range e.b {
+			if _, err := e.pipe.Write(b); err != nil {
+				ffmpegFailures.WithLabelValues("write").Inc()
+				e.log.Errorf("Error writing to ffmpeg: %v", err)
+				// ffmpeg is of no further use; make sure it exits so that
+				// it is restarted.
+				e.cmd.Process.Kill()
+				// Drain remaining frames so Put never blocks.
+				for range e.b {
+				}
+				return
+			}
+		}
+	}()
+	return e, nil
+}
+
+func (e *pipeEncoder) Put(input source.Image) {
+	b := input.Mat.ToBytes()
+	c := make([]byte, len(b))
+	copy(c, b)
+
+	select {
+	case e.b <- c:
+	default:
+		ffmpegDroppedFrames.Inc()
+	}
+}
+
+// Done is closed once ffmpeg has exited, including when it fails while
+// running.
+func (e *pipeEncoder) Done() <-chan bool {
+	return e.exited
+}
+
+// Close stops ffmpeg, killing it if it does not exit promptly.
+func (e *pipeEncoder) Close() {
+	close(e.b)
+	<-e.writerDone
+	e.pipe.Close()
+
+	select {
+	case <-e.exited:
+		if e.waitErr != nil {
+			e.log.Warnf("ffmpeg exited: %v %s", e.waitErr, e.lastErr)
+		}
+	case <-time.After(pipeCloseTimeout):
+		e.cmd.Process.Kill()
+		<-e.exited
+	}
+}
+
+// liveEncoder manages the pipeEncoder of an on-demand live output. A failed
+// encoder is detected and torn down so that it is restarted, and teardown
+// happens in the background so that ffmpeg exiting does not hold up capture.
+// Must only be used from a single goroutine.
+type liveEncoder struct {
+	log *log.Entry
+	fps int
+
+	pipe    *pipeEncoder
+	enc     *FPSNormalize
+	cleanup func()
+
+	failedAt time.Time
+	// stopping is closed once the previous encoder has been torn down.
+	stopping chan bool
+}
+
+// running returns whether an encoder is running. An encoder which has exited
+// unexpectedly is stopped, and restarted after liveRetryDelay.
+func (l *liveEncoder) running() bool {
+	if l.enc == nil {
+		return false
+	}
+	select {
+	case <-l.pipe.Done():
+		l.log.Warnf("Encoder exited unexpectedly, restarting: %v %s", l.pipe.waitErr, l.pipe.lastErr)
+		l.stop()
+		l.failed()
+		return false
+	default:
+		return true
+	}
+}
+
+// ready returns whether a new encoder may be started.
+func (l *liveEncoder) ready() bool {
+	if l.stopping != nil {
+		select {
+		case <-l.stopping:
+			l.stopping = nil
+		default:
+			return false
+		}
+	}
+	return time.Since(l.failedAt) >= liveRetryDelay
+}
+
+// start begins feeding images to e, which is normalized to a constant frame
+// rate. cleanup, if set, is run after e has been closed.
+func (l *liveEncoder) start(e *pipeEncoder, cleanup func()) {
+	l.pipe = e
+	l.enc = NewFPSNormalize(e, l.fps)
+	l.cleanup = cleanup
+}
+
+// failed delays the next start after an encoder could not be started or
+// crashed.
+func (l *liveEncoder) failed() {
+	l.failedAt = time.Now()
+}
+
+func (l *liveEncoder) Put(input source.Image) {
+	l.enc.Put(input)
+}
+
+// stop tears down the running encoder in the background.
+func (l *liveEncoder) stop() {
+	enc, cleanup := l.enc, l.cleanup
+	l.pipe, l.enc, l.cleanup = nil, nil, nil
+	stopping := make(chan bool)
+	l.stopping = stopping
+	go func() {
+		defer close(stopping)
+		enc.Close()
+		if cleanup != nil {
+			cleanup()
+		}
+	}()
+}
+
+// Close stops the encoder, if running, and waits for it to be torn down.
+func (l *liveEncoder) Close() {
+	if l.enc != nil {
+		l.stop()
+	}
+	if l.stopping != nil {
+		<-l.stopping
+	}
+}
@@ -0,0 +1,343 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"cam/util"
+	"cam/video/source"
+)
+
+const (
+	// segmentLayout is the strftime pattern used by ffmpeg to name segments,
+	// and segmentTimeLayout is the equivalent for parsing them back. Names are
+	// followed by the number of the ffmpeg run, so that a restart within the
+	// same second does not overwrite a segment.
+	segmentLayout     = "%Y%m%d-%H%M%S"
+	segmentTimeLayout = "20060102-150405"
+
+	// segmentRetryDelay defines the time to wait before restarting ffmpeg.
+	segmentRetryDelay = 2 * time.Second
+)
+
+type SegmentRingOptions struct {
+	// URI of the camera stream to copy.
+	URI string
+
+	// Dir holds the rolling segments. Any existing contents are removed.
+	Dir string
+
+	// SegmentTime is the target duration of each segment. Actual segments will
+	// be split on the nearest keyframe.
+	SegmentTime time.Duration
+
+	// Retain is the minimum amount of history which must be available when a
+	// clip is started, typically the recorder buffer time.
+	Retain time.Duration
+}
+
+// SegmentRing continuously copies the native camera stream into short
+// segments without re-encoding, keeping a rolling window of recent history so
+// that clips can include pre-roll.
+type SegmentRing struct {
+	opts  SegmentRingOptions
+	log   *log.Entry
+	close chan chan bool
+
+	// pins holds the start time of clips in progress. Segments needed by these
+	// clips will not be removed.
+	pins map[*SegmentClip]time.Time
+	l    sync.Mutex
+}
+
+type segment struct {
+	path  string
+	start time.Time
+	run   int
+}
+
+// segmentName returns the ffmpeg output pattern for a run.
+func segmentName(run int) string {
+	return fmt.Sprintf("%s-%d.ts", segmentLayout, run)
+}
+
+// parseSegmentName returns the start time and run of a segment.
+func parseSegmentName(name string) (time.Time, int, bool) {
+	base := strings.TrimSuffix(name, ".ts")
+	i := strings.LastIndex(base, "-")
+	if base == name || i < 0 {
+		return time.Time{}, 0, false
+	}
+	run, err := strconv.Atoi(base[i+1:])
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	t, err := time.ParseInLocation(segmentTimeLayout, base[:i], time.Local)
+	if err != nil {
+		return time.Time{}, 0, false
+	}
+	return t, run, true
+}
+
+func NewSegmentRing(opts SegmentRingOptions) (*SegmentRing, error) {
+	if err := os.RemoveAll(opts.Dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, err
+	}
+	r := &SegmentRing{
+		opts:  opts,
+		log:   log.WithField("segments", opts.Dir),
+		close: make(chan chan bool),
+		pins:  make(map[*SegmentClip]time.Time),
+	}
+	go r.loop()
+	return r, nil
+}
+
+func (r *SegmentRing) command(run int) (*exec.Cmd, error) {
+	ffmpeg, err := util.LocateFFmpeg()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-hide_banner", "-nostats", "-loglevel", "warning"}
+	if strings.HasPrefix(r.opts.URI, "rtsp://") {
+		args = append(args, "-rtsp_transport", "tcp")
+	}
+	if !strings.Contains(r.opts.URI, "://") {
+		// Local files are used for testing; read them as if they were live.
+		args = append(args, "-re")
+	}
+	args = append(args,
+		"-i", r.opts.URI,
+		// Copy video only, camera audio codecs are often not mp4 compatible.
+		"-map", "0:v",
+		"-c", "copy",
+		"-f", "segment",
+		"-segment_time", fmt.Sprintf("%.3f", r.opts.SegmentTime.Seconds()),
+		"-segment_format", "mpegts",
+		"-reset_timestamps", "1",
+		"-strftime", "1",
+		filepath.Join(r.opts.Dir, segmentName(run)),
+	)
+	return exec.Command(ffmpeg, args...), nil
+}
+
+func (r *SegmentRing) loop() {
+	cleanup := time.NewTicker(r.opts.SegmentTime)
+	defer cleanup.Stop()
+
+	for run := 0; ; run++ {
+		c, err := r.command(run)
+		var exited chan error
+		var logDone chan bool
+		if err == nil {
+			logDone, err = r.start(c)
+		}
+		if err != nil {
+			r.log.Errorf("Failed to start segment recording: %v", err)
+		} else {
+			exited = make(chan error, 1)
+			go func() {
+				// Wait must not be called before all of stderr has been
+				// read.
+				<-logDone
+				exited <- c.Wait()
+			}()
+		}
+
+		retry := time.After(segmentRetryDelay)
+	running:
+		for {
+			select {
+			case cc := <-r.close:
+				if exited != nil {
+					c.Process.Kill()
+					<-exited
+				}
+				cc <- true
+				return
+			case <-cleanup.C:
+				r.cleanup()
+			case err := <-exited:
+				ffmpegFailures.WithLabelValues("segment").Inc()
+				r.log.Errorf("Segment recording exited: %v", err)
+				exited = nil
+				retry = time.After(segmentRetryDelay)
+			case <-retry:
+				if exited == nil {
+					break running
+				}
+			}
+		}
+	}
+}
+
+// start runs ffmpeg, returning a channel which is closed once all of its
+// output has been logged.
+func (r *SegmentRing) start(c *exec.Cmd) (chan bool, error) {
+	stderr, err := c.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	r.log.Infof("Started copying %v into segments", r.opts.URI)
+	var last string
+	done := make(chan bool)
+	go forwardLog(stderr, r.log.WithField("pid", c.Process.Pid), &last, done)
+	return done, nil
+}
+
+// segments lists the available segments, oldest first.
+func (r *SegmentRing) segments() []segment {
+	entries, err := os.ReadDir(r.opts.Dir)
+	if err != nil {
+		r.log.Errorf("Failed to list segments: %v", err)
+		return nil
+	}
+	var segs []segment
+	for _, e := range entries {
+		t, run, ok := parseSegmentName(e.Name())
+		if !ok {
+			continue
+		}
+		segs = append(segs, segment{
+			path:  filepath.Join(r.opts.Dir, e.Name()),
+			start: t,
+			run:   run,
+		})
+	}
+	sort.Slice(segs, func(i, j int) bool {
+		if segs[i].start.Equal(segs[j].start) {
+			return segs[i].run < segs[j].run
+		}
+		return segs[i].start.Before(segs[j].start)
+	})
+	return segs
+}
+
+// cleanup removes segments which are older than needed by the retention
+// window or any clip in progress.
+func (r *SegmentRing) cleanup() {
+	cutoff := time.Now().Add(-r.opts.Retain - r.opts.SegmentTime)
+	r.l.Lock()
+	for _, t := range r.pins {
+		if t.Before(cutoff) {
+			cutoff = t
+		}
+	}
+	r.l.Unlock()
+
+	segs := r.segments()
+	// Segments end when the next one starts; the newest is still being written.
+	for i := 0; i+1 < len(segs); i++ {
+		if !segs[i+1].start.Before(cutoff) {
+			break
+		}
+		if err := os.Remove(segs[i].path); err != nil {
+			r.log.Errorf("Failed to remove old segment: %v", err)
+		}
+	}
+}
+
+// NewClip begins a clip which will contain the stream from start until the
+// clip is closed.
+func (r *SegmentRing) NewClip(path string, start time.Time) *SegmentClip {
+	c := &SegmentClip{
+		Path:  path,
+		ring:  r,
+		start: start,
+	}
+	r.l.Lock()
+	r.pins[c] = start
+	r.l.Unlock()
+	return c
+}
+
+func (r *SegmentRing) Close() {
+	c := make(chan bool)
+	r.close <- c
+	<-c
+}
+
+// SegmentClip implements Sink by stitching together segments from a
+// SegmentRing. Images put to the clip are ignored, since video is taken
+// directly from the camera stream.
+type SegmentClip struct {
+	Path string
+
+	ring  *SegmentRing
+	start time.Time
+	err   error
+}
+
+func (c *SegmentClip) Put(input source.Image) {}
+
+// Close waits for the segment containing the current time to complete, then
+// joins all segments overlapping the clip into the output file.
+func (c *SegmentClip) Close() {
+	defer func() {
+		c.ring.l.Lock()
+		delete(c.ring.pins, c)
+		c.ring.l.Unlock()
+	}()
+
+	end := time.Now()
+	deadline := end.Add(3 * c.ring.opts.SegmentTime)
+	var segs []segment
+	for {
+		segs = c.ring.segments()
+		if n := len(segs); n > 0 && segs[n-1].start.After(end) {
+			break
+		}
+		if time.Now().After(deadline) {
+			c.ring.log.Warnf("Timed out waiting for segment completion, clip %v may be truncated", c.Path)
+			break
+		}
+		time.Sleep(c.ring.opts.SegmentTime / 4)
+	}
+
+	var inputs []string
+	for i, s := range segs {
+		if s.start.After(end) {
+			break
+		}
+		if i+1 < len(segs) && !segs[i+1].start.After(c.start) {
+			continue // Ends before the clip starts.
+		}
+		inputs = append(inputs, s.path)
+	}
+	if len(inputs) == 0 {
+		c.err = fmt.Errorf("no segments available between %v and %v", c.start, end)
+		return
+	}
+
+	ffmpeg, err := util.LocateFFmpeg()
+	if err != nil {
+		c.err = err
+		return
+	}
+	c.ring.log.Infof("Joining %d segments into %v", len(inputs), c.Path)
+	if err := concatFiles(ffmpeg, inputs, c.Path); err != nil {
+		ffmpegFailures.WithLabelValues("concat").Inc()
+		c.err = err
+	}
+}
+
+// Err returns any error encountered while creating the clip. Only valid after
+// Close has returned.
+func (c *SegmentClip) Err() error {
+	return c.err
+}
@@ -0,0 +1,176 @@
+package source
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+
+	"cam/config"
+
+	"gocv.io/x/gocv"
+)
+
+// Transform is a Source which corrects the images of another source: lens
+// undistortion, crop, rotation and flips, in that order.
+type Transform struct {
+	src Source
+	cfg config.TransformConfig
+
+	// Undistortion parameters, initialized from the first image.
+	k, d       gocv.Mat
+	map1, map2 gocv.Mat
+	mapSize    image.Point // Zero until initialized.
+}
+
+// NewTransform wraps a source. If the configuration has no effect, the source
+// is returned unchanged.
+func NewTransform(src Source, cfg config.TransformConfig) (Source, error) {
+	if cfg.IsZero() {
+		return src, nil
+	}
+	switch cfg.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return nil, fmt.Errorf("rotation must be a multiple of 90 degrees, got %d", cfg.Rotate)
+	}
+	if u := cfg.Undistort; u != nil {
+		if u.FX <= 0 || u.FY <= 0 {
+			return nil, fmt.Errorf("undistort requires focal lengths")
+		}
+		if u.Fisheye && len(u.DistCoeffs) != 4 {
+			return nil, fmt.Errorf("fisheye undistort requires 4 distortion coefficients, got %d", len(u.DistCoeffs))
+		}
+		if !u.Fisheye && len(u.DistCoeffs) < 4 {
+			return nil, fmt.Errorf("undistort requires at least 4 distortion coefficients, got %d", len(u.DistCoeffs))
+		}
+	}
+	return &Transform{
+		src: src,
+		cfg: cfg,
+	}, nil
+}
+
+func (t *Transform) Get() <-chan Image {
+	in := t.src.Get()
+	c := make(chan Image)
+	go func() {
+		for i := range in {
+			c <- t.apply(i)
+		}
+		close(c)
+	}()
+	return c
+}
+
+// Size returns the size of transformed images. This will block until the
+// underlying source is initially opened.
+func (t *Transform) Size() image.Point {
+	sz := t.cfg.Crop.Rect(t.src.Size()).Size()
+	if t.cfg.Rotate == 90 || t.cfg.Rotate == 270 {
+		sz.X, sz.Y = sz.Y, sz.X
+	}
+	return sz
+}
+
+func (t *Transform) Connected() bool {
+	return t.src.Connected()
+}
+
+func (t *Transform) Close() {
+	t.src.Close()
+	t.closeUndistort()
+}
+
+func (t *Transform) closeUndistort() {
+	if t.mapSize == (image.Point{}) {
+		return
+	}
+	t.k.Close()
+	t.d.Close()
+	t.map1.Close()
+	t.map2.Close()
+	t.mapSize = image.Point{}
+}
+
+// apply transforms the image, taking ownership of the input.
+func (t *Transform) apply(i Image) Image {
+	cur := i.Mat
+	replace := func(dst gocv.Mat) {
+		cur.Close()
+		cur = dst
+	}
+
+	if t.cfg.Undistort != nil {
+		dst := gocv.NewMat()
+		t.undistort(cur, &dst)
+		replace(dst)
+	}
+
+	if !t.cfg.Crop.IsZero() {
+		region := cur.Region(t.cfg.Crop.Rect(image.Point{X: cur.Cols(), Y: cur.Rows()}))
+		dst := region.Clone()
+		region.Close()
+		replace(dst)
+	}
+
+	if t.cfg.Rotate != 0 {
+		dst := gocv.NewMat()
+		switch t.cfg.Rotate {
+		case 90:
+			gocv.Rotate(cur, &dst, gocv.Rotate90Clockwise)
+		case 180:
+			gocv.Rotate(cur, &dst, gocv.Rotate180Clockwise)
+		case 270:
+			gocv.Rotate(cur, &dst, gocv.Rotate90CounterClockwise)
+		}
+		replace(dst)
+	}
+
+	if t.cfg.FlipH || t.cfg.FlipV {
+		code := 0 // Around the x-axis, i.e. vertical.
+		if t.cfg.FlipH && t.cfg.FlipV {
+			code = -1
+		} else if t.cfg.FlipH {
+			code = 1
+		}
+		dst := gocv.NewMat()
+		gocv.Flip(cur, &dst, code)
+		replace(dst)
+	}
+
+	return Image{Mat: cur, Time: i.Time}
+}
+
+// undistort corrects lens distortion, keeping the image size. The remap for
+// the standard model is computed once per input size.
+func (t *Transform) undistort(src gocv.Mat, dst *gocv.Mat) {
+	u := t.cfg.Undistort
+	sz := image.Point{X: src.Cols(), Y: src.Rows()}
+	if t.mapSize != sz {
+		t.closeUndistort()
+		t.k = gocv.Zeros(3, 3, gocv.MatTypeCV64F)
+		t.k.SetDoubleAt(0, 0, u.FX)
+		t.k.SetDoubleAt(1, 1, u.FY)
+		t.k.SetDoubleAt(0, 2, u.CX)
+		t.k.SetDoubleAt(1, 2, u.CY)
+		t.k.SetDoubleAt(2, 2, 1)
+		t.d = gocv.Zeros(1, len(u.DistCoeffs), gocv.MatTypeCV64F)
+		for i, v := range u.DistCoeffs {
+			t.d.SetDoubleAt(0, i, v)
+		}
+		t.map1 = gocv.NewMat()
+		t.map2 = gocv.NewMat()
+		t.mapSize = sz
+		if !u.Fisheye {
+			r := gocv.NewMat()
+			gocv.InitUndistortRectifyMap(t.k, t.d, r, t.k, sz, int(gocv.MatTypeCV32F), t.map1, t.map2)
+			r.Close()
+		}
+	}
+
+	if u.Fisheye {
+		gocv.FisheyeUndistortImageWithParams(src, dst, t.k, t.d, t.k, sz)
+		return
+	}
+	gocv.Remap(src, dst, &t.map1, &t.map2, gocv.InterpolationLinear, gocv.BorderConstant, color.RGBA{})
+}
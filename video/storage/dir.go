@@ -0,0 +1,64 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Dir stores objects in a local directory, typically a network mount.
+type Dir struct {
+	path string
+}
+
+func NewDir(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	return &Dir{path: path}, nil
+}
+
+func (d *Dir) Upload(ctx context.Context, key, path, contentType string) (int64, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst := filepath.Join(d.path, key)
+	tmp, err := os.CreateTemp(d.path, filepath.Base(key)+".*.temp")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, src)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (d *Dir) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	return os.Open(filepath.Join(d.path, key))
+}
+
+func (d *Dir) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(filepath.Join(d.path, key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (d *Dir) PresignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	return "", ErrNotSupported
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type S3Options struct {
+	// Endpoint is the host (and port) of the S3-compatible service, e.g.
+	// "s3.amazonaws.com" or "localhost:9000" for MinIO.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// Prefix is prepended to all keys, allowing a bucket to be shared.
+	Prefix string
+
+	AccessKey string
+	SecretKey string
+	UseSSL    bool
+}
+
+// S3 stores objects in an S3-compatible bucket.
+type S3 struct {
+	opts   S3Options
+	client *minio.Client
+}
+
+// NewS3 connects to the service and checks that the bucket exists.
+func NewS3(opts S3Options) (*S3, error) {
+	client, err := minio.New(opts.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(opts.AccessKey, opts.SecretKey, ""),
+		Secure: opts.UseSSL,
+		Region: opts.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	ok, err := client.BucketExists(ctx, opts.Bucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check bucket %v: %v", opts.Bucket, err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("bucket %v does not exist", opts.Bucket)
+	}
+	return &S3{
+		opts:   opts,
+		client: client,
+	}, nil
+}
+
+func (s *S3) key(key string) string {
+	return path.Join(s.opts.Prefix, key)
+}
+
+func (s *S3) Upload(ctx context.Context, key, path, contentType string) (int64, error) {
+	info, err := s.client.FPutObject(ctx, s.opts.Bucket, s.key(key), path, minio.PutObjectOptions{
+		ContentType: contentType,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3) Open(ctx context.Context, key string) (io.ReadSeekCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.opts.Bucket, s.key(key), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	// GetObject is lazy; surface missing objects now.
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.opts.Bucket, s.key(key), minio.RemoveObjectOptions{})
+}
+
+func (s *S3) PresignedURL(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, s.opts.Bucket, s.key(key), expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
@@ -0,0 +1,52 @@
+// Package storage provides backends for keeping event files off the local
+// disk.
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"cam/config"
+)
+
+// ErrNotSupported is returned by backends which can't provide a feature.
+var ErrNotSupported = errors.New("not supported by storage backend")
+
+// Backend stores files by key.
+type Backend interface {
+	// Upload copies a local file to key, returning its size.
+	Upload(ctx context.Context, key, path, contentType string) (int64, error)
+
+	// Open reads the object stored at key.
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, error)
+
+	// Delete removes the object at key. Deleting a missing object is not an
+	// error.
+	Delete(ctx context.Context, key string) error
+
+	// PresignedURL returns a time-limited URL for reading key directly from
+	// the backend, or ErrNotSupported.
+	PresignedURL(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// New creates the backend described by the configuration.
+func New(cfg *config.StorageConfig) (Backend, error) {
+	switch cfg.Type {
+	case "s3":
+		return NewS3(S3Options{
+			Endpoint:  cfg.Endpoint,
+			Region:    cfg.Region,
+			Bucket:    cfg.Bucket,
+			Prefix:    cfg.Prefix,
+			AccessKey: cfg.AccessKey,
+			SecretKey: cfg.SecretKey,
+			UseSSL:    cfg.UseSSL,
+		})
+	case "dir":
+		return NewDir(cfg.Dir)
+	}
+	return nil, fmt.Errorf("unknown storage type %q", cfg.Type)
+}
@@ -0,0 +1,155 @@
+package video
+
+import (
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultTrashExpiry is how long trashed events are kept if
+// FilesystemOptions.TrashExpiry is unset.
+const DefaultTrashExpiry = 7 * 24 * time.Hour
+
+// Trash moves the record to the trash. It is hidden from listings, but its
+// files are kept until it is restored or purged by garbage collection.
+// Outstanding jobs for the record are dropped, and any running are cancelled;
+// they are scheduled again periodically once the record is restored.
+func (r *VideoRecord) Trash() error {
+	if r.Recording() {
+		return errors.New("event is still recording")
+	}
+	defer r.fs.notifyListeners()
+	r.l.Lock()
+	defer r.l.Unlock()
+	if err := r.fs.db.Delete(r).Error; err != nil {
+		return err
+	}
+	if err := r.fs.db.Unscoped().Where("identifier = ? AND state <> ?", r.Identifier, JobRunning).Delete(&Job{}).Error; err != nil {
+		log.Errorf("Failed to drop jobs for trashed event %v: %v", r.Identifier, err)
+	}
+	// Updates from running jobs would leave the trashed record alone, but
+	// there is no point finishing them.
+	r.fs.cancelJobs(r.Identifier)
+	log.Infof("Moved event %v to trash", r.Identifier)
+	return nil
+}
+
+// Restore takes the record out of the trash.
+func (r *VideoRecord) Restore() error {
+	defer r.fs.notifyListeners()
+	r.l.Lock()
+	defer r.l.Unlock()
+	if err := r.fs.db.Unscoped().Model(r).Update("deleted_at", nil).Error; err != nil {
+		return err
+	}
+	log.Infof("Restored event %v from trash", r.Identifier)
+	return nil
+}
+
+// Trashed returns whether the record is in the trash.
+func (r *VideoRecord) Trashed() bool {
+	return r.DeletedAt.Valid
+}
+
+// trashExpiry returns how long trashed records are kept.
+func (f *Filesystem) trashExpiry() time.Duration {
+	if f.options.TrashExpiry == 0 {
+		return DefaultTrashExpiry
+	}
+	return f.options.TrashExpiry
+}
+
+// GetTrash lists records in the trash, most recently trashed first.
+func (f *Filesystem) GetTrash() []*VideoRecord {
+	var records []*VideoRecord
+	err := f.db.Debug().Unscoped().
+		Where("deleted_at IS NOT NULL").
+		Order("deleted_at DESC").
+		Find(&records).Error
+	if err != nil {
+		log.Errorf("Trash lookup failed: %v", err)
+		return []*VideoRecord{}
+	}
+	for _, r := range records {
+		r.fs = f
+	}
+	f.loadAnnotations(records)
+	return records
+}
+
+// GetTrashedRecordByID looks up a record in the trash, returning nil if there
+// is none.
+func (f *Filesystem) GetTrashedRecordByID(ID string) *VideoRecord {
+	var records []*VideoRecord
+	err := f.db.Unscoped().
+		Where("identifier = ? AND deleted_at IS NOT NULL", ID).
+		Limit(1).
+		Find(&records).Error
+	if err != nil {
+		log.Errorf("GetTrashedRecordByID %v over ID %v", err, ID)
+		return nil
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	records[0].fs = f
+	f.loadAnnotations(records)
+	return records[0]
+}
+
+// EmptyTrash permanently deletes every record in the trash, returning how many
+// were deleted.
+func (f *Filesystem) EmptyTrash() int {
+	f.maintenance.Lock()
+	defer f.maintenance.Unlock()
+
+	ne := f.notifyListenersInBatch()
+	defer func() {
+		ne <- true
+	}()
+
+	trash := f.GetTrash()
+	for _, r := range trash {
+		r.Delete()
+	}
+	log.Infof("Emptied trash of %d events", len(trash))
+	return len(trash)
+}
+
+// planTrash determines which of the trash, listed most recently trashed
+// first, to purge: those trashed longer than the trash expiry, then the
+// earliest trashed while the size budget is exceeded, so that the trash never
+// displaces live events of liveSize in total. The remaining
+// trashed records are returned most recently trashed first, along with their
+// combined size.
+func (f *Filesystem) planTrash(now time.Time, trash []*VideoRecord, liveSize int64) (actions []*GCAction, kept []*VideoRecord, keptSize int64) {
+	for _, r := range trash {
+		keptSize += r.Size
+	}
+	expiry := f.trashExpiry()
+	for i := len(trash) - 1; i >= 0; i-- {
+		r := trash[i]
+		a := &GCAction{
+			ID:     r.Identifier,
+			Action: GCDelete,
+			Size:   r.Size + r.RemoteSize,
+			record: r,
+		}
+		switch {
+		case r.DeletedAt.Time.Before(now.Add(-expiry)):
+			a.Reason = "trash expired"
+		case f.options.MaxSize != 0 && liveSize+keptSize > f.options.MaxSize:
+			a.Reason = "trash size"
+		default:
+			kept = append(kept, r)
+			continue
+		}
+		actions = append(actions, a)
+		keptSize -= r.Size
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	return actions, kept, keptSize
+}
@@ -0,0 +1,102 @@
+package video
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// trashedRecord creates a record trashed age before gcNow.
+func trashedRecord(id string, age time.Duration, size int64) *VideoRecord {
+	r := testRecord(id, age+day, size)
+	r.DeletedAt = gorm.DeletedAt{Time: gcNow.Add(-age), Valid: true}
+	return r
+}
+
+func TestPlanTrash(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     FilesystemOptions
+		liveSize int64
+		trash    []*VideoRecord // Most recently trashed first.
+		want     []string
+		wantKept []string
+	}{
+		{
+			name: "default expiry",
+			trash: []*VideoRecord{
+				trashedRecord("a", 1*day, 100),
+				trashedRecord("b", 8*day, 100),
+				trashedRecord("c", 9*day, 100),
+			},
+			want:     []string{"c delete trash expired", "b delete trash expired"},
+			wantKept: []string{"a"},
+		},
+		{
+			name: "configured expiry",
+			opts: FilesystemOptions{TrashExpiry: 12 * time.Hour},
+			trash: []*VideoRecord{
+				trashedRecord("a", time.Hour, 100),
+				trashedRecord("b", day, 100),
+			},
+			want:     []string{"b delete trash expired"},
+			wantKept: []string{"a"},
+		},
+		{
+			name:     "size purges earliest trashed",
+			opts:     FilesystemOptions{MaxSize: 300},
+			liveSize: 150,
+			trash: []*VideoRecord{
+				trashedRecord("a", 1*time.Hour, 100),
+				trashedRecord("b", 2*time.Hour, 100),
+				trashedRecord("c", 3*time.Hour, 100),
+			},
+			want:     []string{"c delete trash size", "b delete trash size"},
+			wantKept: []string{"a"},
+		},
+	} {
+		f := newTestFilesystem(tc.opts)
+		actions, kept, keptSize := f.planTrash(gcNow, tc.trash, tc.liveSize)
+		if got := summarize(actions); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		var keptIDs []string
+		var size int64
+		for _, r := range kept {
+			keptIDs = append(keptIDs, r.Identifier)
+			size += r.Size
+		}
+		if !reflect.DeepEqual(keptIDs, tc.wantKept) {
+			t.Errorf("%s: kept %q, want %q", tc.name, keptIDs, tc.wantKept)
+		}
+		if keptSize != size {
+			t.Errorf("%s: kept size %d, want %d", tc.name, keptSize, size)
+		}
+	}
+}
+
+func TestPlanGarbageCollectWithTrash(t *testing.T) {
+	f := newTestFilesystem(FilesystemOptions{MaxSize: 250, MaxAge: 30 * day})
+	records := []*VideoRecord{
+		testRecord("a", 1*day, 100),
+		testRecord("b", 2*day, 100),
+		testRecord("c", 40*day, 10),
+	}
+	trash := []*VideoRecord{
+		trashedRecord("t1", time.Hour, 40),
+		trashedRecord("t2", 2*time.Hour, 50),
+		trashedRecord("t3", 8*day, 10),
+	}
+	// The trash is purged first, and never displaces live events: only
+	// enough of it is kept to stay within the budget.
+	want := []string{
+		"t3 delete trash expired",
+		"t2 delete trash size",
+		"c delete age",
+	}
+	if got := summarize(f.planRecords(gcNow, records, trash)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -1,6 +1,9 @@
 package video
 
 import (
+	"errors"
+
+	"cam/config"
 	"cam/video/process"
 	"cam/video/sink"
 	"cam/video/source"
@@ -9,13 +12,25 @@ import (
 )
 
 type VideoSinkProducer struct {
-	FFmpegOptions  sink.FFmpegOptions
-	Filesystem     *Filesystem
-	VThumbProducer *process.VThumbProducer
+	FFmpegOptions sink.FFmpegOptions
+	Filesystem    *Filesystem
+	Jobs          *JobQueue
+
+	// If set, clips are stitched together from the camera's native stream
+	// instead of encoding the captured images. The native stream can't be
+	// masked, so captured images are encoded while PrivacyMasks are set.
+	Segments *sink.SegmentRing
+}
+
+// errorSink is a Sink which reports failures once closed.
+type errorSink interface {
+	sink.Sink
+	Err() error
 }
 
 type VideoSink struct {
-	sink sink.Sink
+	sink   sink.Sink
+	output errorSink
 
 	Record *VideoRecord
 
@@ -39,19 +54,48 @@ func (p *VideoSinkProducer) New(trigger source.Image) *VideoSink {
 	}()
 
 	var s sink.Sink
+	var output errorSink
 	path := r.Paths().VideoPath
-	s = sink.NewFFmpegSink(path, p.FFmpegOptions)
-	// Ensure video is output with constant FPS.
-	s = sink.NewFPSNormalize(s, p.FFmpegOptions.FPS)
+	if p.Filesystem.DiskCritical() {
+		// Don't start ffmpeg; the record still shows what was missed.
+		output = &refusedSink{err: errors.New("recording refused, disk critically full")}
+		s = output
+	} else if p.Segments != nil && len(config.Get().PrivacyMasks) > 0 {
+		p.Filesystem.alert("passthrough-masks", "PrivacyMasks are set, so recordings are encoded instead of passed through; switch to the encode record mode")
+		s, output = p.encode(r, path)
+	} else if p.Segments != nil {
+		output = p.Segments.NewClip(path, trigger.Time.Add(-p.FFmpegOptions.BufferTime))
+		s = output
+	} else {
+		s, output = p.encode(r, path)
+	}
 
 	return &VideoSink{
 		sink:       s,
+		output:     output,
 		Record:     r,
 		detections: make(process.Detections),
 		p:          p,
 	}
 }
 
+// encode writes the captured images to path.
+func (p *VideoSinkProducer) encode(r *VideoRecord, path string) (sink.Sink, errorSink) {
+	fs := sink.NewFFmpegSink(path, p.FFmpegOptions)
+	p.Filesystem.setPartial(r.Identifier, fs)
+	// Ensure video is output with constant FPS.
+	return sink.NewFPSNormalize(fs, p.FFmpegOptions.FPS), fs
+}
+
+// refusedSink discards images for a recording which could not be started.
+type refusedSink struct {
+	err error
+}
+
+func (s *refusedSink) Put(input source.Image) {}
+func (s *refusedSink) Close()                 {}
+func (s *refusedSink) Err() error             { return s.err }
+
 func (w *VideoSink) Put(i source.Image) {
 	w.sink.Put(i)
 }
@@ -67,20 +111,34 @@ func (w *VideoSink) AddDetections(detections process.Detections) {
 	w.detections.Merge(detections)
 }
 
+// Close finalizes the video. The record is updated with whatever video could
+// be saved, and marked with any error encountered while writing.
 func (w *VideoSink) Close() {
 	log.Infof("Closing underlying video sink")
 	w.sink.Close()
 
+	if err := w.output.Err(); err != nil {
+		w.Record.SetError(err)
+	}
+
 	log.Infof("Updating database with final record")
 	w.Record.UpdateVideo(w.detections.SortedDetections())
 
-	// Create video thumbnail.
-	log.Infof("Scheduling creation of video thumbnail")
-	paths := w.Record.Paths()
-	c := w.p.VThumbProducer.Process(paths.VideoPath, paths.VThumbPath)
-	go func() {
-		<-c
-		log.Infof("Updating database for video thumbnail")
-		w.Record.UpdateVThumb()
-	}()
+	if !w.Record.HaveVideo {
+		return
+	}
+
+	// Create video thumbnail and scrubbing preview.
+	log.Infof("Scheduling creation of video thumbnail and sprite sheet")
+	w.p.Jobs.Enqueue(w.Record.Identifier, JobVThumb)
+	w.p.Jobs.Enqueue(w.Record.Identifier, JobSprites)
+	if w.p.Filesystem.HasRemote() {
+		w.p.Jobs.Enqueue(w.Record.Identifier, JobOffload)
+	}
+}
+
+// Err returns any error encountered while writing the video. Only valid after
+// Close has returned.
+func (w *VideoSink) Err() error {
+	return w.output.Err()
 }
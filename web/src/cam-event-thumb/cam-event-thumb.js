@@ -92,6 +92,11 @@ class CamEventThumb extends PolymerElement {
                         [[formatAsTime_(event.Timestamp)]]
                       </div>
               </div>
+              <div class="duration" hidden\$="[[!event.Recording]]">
+                      <div class="small">
+                              Recording
+                      </div>
+              </div>
               <div class="duration" hidden\$="[[!event.HaveVideo]]">
                       <div class="small">
                               Duration
@@ -130,7 +135,7 @@ class CamEventThumb extends PolymerElement {
   }
 
   eventClicked_() {
-          if (this.event.HaveVideo) {
+          if (this.event.HaveVideo || this.event.PartialVideo) {
                   this.dispatchEvent(new CustomEvent('open-event', {detail: {event: this.event}, bubbles: true, composed: true}));
           }
   }
@@ -15,6 +15,17 @@ self.addEventListener('push', function(event) {
   console.log("Notification object");
   console.log(notification);
 
+  if (notification.Alert) {
+    event.waitUntil(
+      self.registration.showNotification('Camera alert', {
+        body: `At ${notification.TimeString}: ${notification.Alert}`,
+        tag: 'alert',
+        icon: '/favicon.ico',
+      })
+    );
+    return;
+  }
+
   const cls = notification.Detection.Class;
   const tcls = cls.charAt(0).toUpperCase() + cls.slice(1);
 
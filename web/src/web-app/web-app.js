@@ -156,10 +156,10 @@ class WebApp extends PolymerElement {
 <paper-dialog id="delete" modal="" always-on-top="" on-iron-overlay-closed="onDeleteClosed_">
         <div>
                 <div>
-                        About to permanently delete event [[event.ID]].
+                        About to move event [[event.ID]] to the trash.
                 </div>
                 <div>
-                        <b>Are you sure?</b> This action cannot be undone.
+                        It can be restored until the trash is emptied.
                 </div>
         </div>
         <div class="buttons">
@@ -167,7 +167,12 @@ class WebApp extends PolymerElement {
                 <paper-button dialog-confirm="">Delete</paper-button>
         </div>
 </paper-dialog>
-<paper-toast id="deletetoast">Successfully deleted event [[event.ID]].</paper-toast>
+<iron-ajax id="restoreajax" url="/trash/restore" method="POST" on-response="onRestoreResponse_"></iron-ajax>
+<paper-toast id="deletetoast" duration="10000">
+        Moved event [[deletedID_]] to the trash.
+        <paper-button on-click="undoDelete_">Undo</paper-button>
+</paper-toast>
+<paper-toast id="restoretoast">Restored event [[deletedID_]].</paper-toast>
 `;
   }
 
@@ -182,6 +187,10 @@ class WebApp extends PolymerElement {
             event: {
                     type: Object,
                     value: null,
+            },
+            deletedID_: {
+                    type: String,
+                    value: "",
             }
     };
   }
@@ -209,6 +218,7 @@ class WebApp extends PolymerElement {
           }
 
           this.$.dialog.close();
+          this.deletedID_ = this.event.ID;
           this.$.deleteajax.params = {
                   "id": this.event.ID,
           };
@@ -219,6 +229,18 @@ class WebApp extends PolymerElement {
           this.$.deletetoast.show();
   }
 
+  undoDelete_(e) {
+          this.$.deletetoast.close();
+          this.$.restoreajax.params = {
+                  "id": this.deletedID_,
+          };
+          this.$.restoreajax.generateRequest();
+  }
+
+  onRestoreResponse_(e) {
+          this.$.restoretoast.show();
+  }
+
   openFullscreen_(e) {
           this.$.video.webkitEnterFullScreen();
   }